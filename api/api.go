@@ -1,23 +1,103 @@
 package api
 
 import (
+	"log/slog"
 	gohttp "net/http"
+	"os"
 
 	"github.com/gorilla/pat"
+	"github.com/mailhog/MailHog-Server/auth"
 	"github.com/mailhog/MailHog-Server/config"
+	"github.com/mailhog/MailHog-Server/health"
+	"github.com/mailhog/MailHog-Server/metrics"
+	"github.com/mailhog/MailHog-Server/netutil"
+	"github.com/mailhog/MailHog-Server/tlsutil"
+	"github.com/mailhog/MailHog-Server/websockets"
 )
 
+// Listen serves the API on conf.APIBindAddr
+//
+// The API is served with TLS if conf.APITLS is set. Cross-origin
+// requests are handled according to conf.CORS. If basic auth or API
+// tokens are configured, every other request must include valid
+// credentials, except for /healthz and /readyz so probes don't need any.
+// /metrics requires the read scope, e.g. a read-only token scraped as a
+// bearer token.
+func Listen(conf *config.Config, exitCh chan int) {
+	slog.Info("[HTTP] Binding to address", "addr", conf.APIBindAddr, "tls", conf.APITLS != nil)
+	r := pat.New()
+	CreateAPI(conf, r)
+
+	server := &gohttp.Server{
+		Addr:      conf.APIBindAddr,
+		Handler:   handler(conf, r),
+		TLSConfig: conf.APITLS,
+	}
+	ln, err := netutil.Listen(conf.APIBindAddr, conf.SocketMode)
+	if err == nil {
+		if conf.APITLS != nil {
+			if len(conf.APIRedirectAddr) > 0 {
+				go redirectToHTTPS(conf)
+			}
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+	}
+	if err != nil {
+		slog.Error("[HTTP] Error binding to address", "addr", conf.APIBindAddr, "error", err)
+		os.Exit(1)
+	}
+}
+
+// handler wraps the API router r with CORS and authentication
+func handler(conf *config.Config, r gohttp.Handler) gohttp.Handler {
+	return conf.CORS.Handler(auth.Handler(r, conf.WebPath+"/healthz", conf.WebPath+"/readyz"))
+}
+
+func redirectToHTTPS(conf *config.Config) {
+	slog.Info("[HTTP] Binding HTTPS redirect to address", "addr", conf.APIRedirectAddr)
+	ln, err := netutil.Listen(conf.APIRedirectAddr, conf.SocketMode)
+	if err == nil {
+		err = gohttp.Serve(ln, tlsutil.RedirectHandler(conf.APIBindAddr))
+	}
+	if err != nil {
+		slog.Error("[HTTP] Error binding to address", "addr", conf.APIRedirectAddr, "error", err)
+		os.Exit(1)
+	}
+}
+
 func CreateAPI(conf *config.Config, r gohttp.Handler) {
-	apiv1 := createAPIv1(conf, r.(*pat.Router))
-	apiv2 := createAPIv2(conf, r.(*pat.Router))
+	wsHub := websockets.NewHub(conf.EventHistory)
+	wsHub.Origins = conf.CORS.Origins
+	wsHub.Authorised = func(r *gohttp.Request) bool {
+		return auth.Allowed(r, auth.Read)
+	}
+	createAPIv1(conf, r.(*pat.Router), wsHub)
+	createAPIv2(conf, r.(*pat.Router), wsHub)
+
+	// CORS is applied by the router as well as by Listen, so APIs served
+	// without Listen handle cross-origin requests the same way. OPTIONS
+	// requests are answered by the policy.
+	r.(*pat.Router).Use(conf.CORS.Handler)
+	r.(*pat.Router).PathPrefix(conf.WebPath + "/").Methods("OPTIONS").HandlerFunc(func(gohttp.ResponseWriter, *gohttp.Request) {})
 
+	metrics.WatchStorage(conf.Storage)
+	r.(*pat.Router).Path(conf.WebPath + "/metrics").Methods("GET").HandlerFunc(auth.Require(auth.Read, metrics.Handler().ServeHTTP))
+
+	webhooks := health.NewFlag("webhook notifier not running")
+	health.Register("webhooks", webhooks.Check)
+	health.Register("bus", conf.Bus.Check)
+	health.Register("storage", health.PingStorage(conf.Storage))
+	r.(*pat.Router).Path(conf.WebPath + "/healthz").Methods("GET").HandlerFunc(healthz)
+	r.(*pat.Router).Path(conf.WebPath + "/readyz").Methods("GET").HandlerFunc(readyz)
+
+	sub := conf.Bus.Subscribe("webhooks", conf.BusBuffer)
 	go func() {
-		for {
-			select {
-			case msg := <-conf.MessageChan:
-				apiv1.messageChan <- msg
-				apiv2.messageChan <- msg
-			}
+		webhooks.Set(true)
+		defer webhooks.Set(false)
+		for msg := range sub.C {
+			conf.Webhooks.Notify(msg)
 		}
 	}()
 }
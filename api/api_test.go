@@ -0,0 +1,86 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/gorilla/pat"
+	"github.com/mailhog/MailHog-Server/auth"
+	"github.com/mailhog/MailHog-Server/config"
+	"github.com/mailhog/MailHog-Server/cors"
+	"github.com/mailhog/MailHog-Server/transcript"
+	"github.com/mailhog/MailHog-Server/webhooks"
+	"github.com/mailhog/storage"
+)
+
+func testConfig() *config.Config {
+	conf := config.DefaultConfig()
+	conf.Storage = storage.CreateInMemory()
+	conf.Transcripts = transcript.NewStore(10, 10)
+	conf.Webhooks = webhooks.NewDispatcher()
+	return conf
+}
+
+func TestHandler(t *testing.T) {
+	Convey("Health checks should be served without credentials", t, func() {
+		auth.Tokens = []*auth.Token{{Token: "secret", Scopes: auth.Scopes{auth.Read}}}
+		defer func() { auth.Tokens = nil }()
+
+		conf := testConfig()
+		r := pat.New()
+		CreateAPI(conf, r)
+		h := handler(conf, r)
+
+		get := func(path, token string) int {
+			req := httptest.NewRequest("GET", path, nil)
+			if len(token) > 0 {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		So(get("/healthz", ""), ShouldEqual, 200)
+		So(get("/readyz", ""), ShouldNotEqual, 401)
+		So(get("/api/v2/messages", ""), ShouldEqual, 401)
+		So(get("/metrics", ""), ShouldEqual, 401)
+		So(get("/metrics", "secret"), ShouldEqual, 200)
+	})
+}
+
+func TestCreateAPI(t *testing.T) {
+	Convey("CreateAPI should apply the CORS policy", t, func() {
+		conf := testConfig()
+		conf.CORS = cors.NewPolicy("https://ui.example.com", false, "Content-Type", "", 0)
+		r := pat.New()
+		CreateAPI(conf, r)
+
+		for _, path := range []string{"/api/v1/messages", "/api/v2/jim", "/api/v2/messages"} {
+			req := httptest.NewRequest("OPTIONS", path, nil)
+			req.Header.Set("Origin", "https://ui.example.com")
+			req.Header.Set("Access-Control-Request-Method", "DELETE")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 204)
+			So(w.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "https://ui.example.com")
+			So(w.Header().Get("Access-Control-Allow-Methods"), ShouldEqual, cors.Methods)
+		}
+
+		req := httptest.NewRequest("GET", "/healthz", nil)
+		req.Header.Set("Origin", "https://ui.example.com")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		So(w.Code, ShouldEqual, 200)
+		So(w.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "https://ui.example.com")
+
+		Convey("once when it's also applied by Listen", func() {
+			w := httptest.NewRecorder()
+			handler(conf, r).ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 200)
+			So(w.Header()["Vary"], ShouldResemble, []string{"Origin"})
+		})
+	})
+}
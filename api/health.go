@@ -0,0 +1,37 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mailhog/MailHog-Server/health"
+)
+
+type healthResult struct {
+	Status     string                   `json:"status"`
+	Components map[string]health.Result `json:"components,omitempty"`
+}
+
+// healthz reports that the process is up
+func healthz(w http.ResponseWriter, req *http.Request) {
+	b, _ := json.Marshal(healthResult{Status: "ok"})
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// readyz reports the readiness of each registered component
+func readyz(w http.ResponseWriter, req *http.Request) {
+	results, ok := health.Run()
+
+	res := healthResult{Status: "ok", Components: results}
+	if !ok {
+		res.Status = "fail"
+	}
+
+	b, _ := json.Marshal(res)
+	w.Header().Add("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(503)
+	}
+	w.Write(b)
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mailhog/MailHog-Server/health"
+	"github.com/mailhog/storage"
+)
+
+func getReadyz() (int, healthResult) {
+	w := httptest.NewRecorder()
+	readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	var res healthResult
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return w.Code, res
+}
+
+func TestReadyz(t *testing.T) {
+	Convey("readyz should report the status of each component", t, func() {
+		// other tests call CreateAPI, which registers these too
+		health.Register("webhooks", func() error { return nil })
+		health.Register("bus", func() error { return nil })
+		health.Register("apiv2", func() error { return nil })
+
+		smtp := health.NewFlag("listener not bound")
+		smtp.Set(true)
+		health.Register("smtp", smtp.Check)
+		health.Register("storage", health.PingStorage(&storage.Maildir{Path: t.TempDir()}))
+
+		code, res := getReadyz()
+		So(code, ShouldEqual, 200)
+		So(res.Status, ShouldEqual, "ok")
+		So(res.Components["smtp"], ShouldResemble, health.Result{Status: "ok"})
+		So(res.Components["storage"], ShouldResemble, health.Result{Status: "ok"})
+
+		Convey("and fail if the SMTP listener isn't bound", func() {
+			smtp.Set(false)
+			code, res := getReadyz()
+			So(code, ShouldEqual, 503)
+			So(res.Status, ShouldEqual, "fail")
+			So(res.Components["smtp"], ShouldResemble, health.Result{Status: "fail", Error: "listener not bound"})
+			So(res.Components["storage"].Status, ShouldEqual, "ok")
+		})
+
+		Convey("and fail if storage doesn't answer", func() {
+			health.Register("storage", health.PingStorage(&storage.Maildir{Path: "/nonexistent/maildir"}))
+			code, res := getReadyz()
+			So(code, ShouldEqual, 503)
+			So(res.Status, ShouldEqual, "fail")
+			So(res.Components["smtp"].Status, ShouldEqual, "ok")
+			So(res.Components["storage"].Status, ShouldEqual, "fail")
+			So(res.Components["storage"].Error, ShouldNotBeEmpty)
+		})
+	})
+}
+
+func TestHealthz(t *testing.T) {
+	Convey("healthz should report the process is up", t, func() {
+		w := httptest.NewRecorder()
+		healthz(w, httptest.NewRequest("GET", "/healthz", nil))
+		So(w.Code, ShouldEqual, 200)
+		So(w.Body.String(), ShouldEqual, `{"status":"ok"}`)
+	})
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/mailhog/MailHog-Server/monkey"
+	"github.com/mailhog/MailHog-Server/websockets"
+)
+
+func (apiv2 *APIv2) listRules(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] GET /api/v2/chaos/rules")
+
+	b, _ := json.Marshal(apiv2.config.Rules.List())
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) replaceRules(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] PUT /api/v2/chaos/rules")
+
+	rules := make([]*monkey.Rule, 0)
+	if err := json.NewDecoder(req.Body).Decode(&rules); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	if err := apiv2.config.Rules.Set(rules); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	apiv2.rulesChanged()
+
+	b, _ := json.Marshal(rules)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) rule(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	slog.Debug("[APIv2] GET /api/v2/chaos/rules/{id}", "id", id)
+
+	r, ok := apiv2.config.Rules.Get(id)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+
+	b, _ := json.Marshal(r)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) createRule(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] POST /api/v2/chaos/rules")
+
+	var r monkey.Rule
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	r.ID = ""
+
+	if err := apiv2.config.Rules.Add(&r); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	apiv2.rulesChanged()
+
+	b, _ := json.Marshal(&r)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(201)
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) updateRule(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	slog.Debug("[APIv2] PUT /api/v2/chaos/rules/{id}", "id", id)
+
+	var r monkey.Rule
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	err := apiv2.config.Rules.Update(id, &r)
+	if err == monkey.ErrRuleNotFound {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	apiv2.rulesChanged()
+
+	b, _ := json.Marshal(&r)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) deleteRule(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	slog.Debug("[APIv2] DELETE /api/v2/chaos/rules/{id}", "id", id)
+
+	if err := apiv2.config.Rules.Remove(id); err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	apiv2.rulesChanged()
+}
+
+func (apiv2 *APIv2) rulesChanged() {
+	apiv2.wsHub.Publish(&websockets.Event{Type: websockets.RulesChanged, Data: apiv2.config.Rules.List()})
+}
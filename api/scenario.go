@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/mailhog/MailHog-Server/monkey"
+)
+
+func (apiv2 *APIv2) scenario(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] GET /api/v2/jim/scenario")
+
+	s := apiv2.config.Scenario.Status()
+	if s == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	b, _ := json.Marshal(s)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) loadScenario(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] PUT /api/v2/jim/scenario")
+
+	var s monkey.Scenario
+	if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	if err := apiv2.config.Scenario.Load(&s, apiv2.config.Monkey.Load().Jim); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if req.URL.Query().Get("start") == "true" {
+		apiv2.config.Scenario.Start()
+	}
+
+	apiv2.writeScenarioStatus(w)
+}
+
+func (apiv2 *APIv2) unloadScenario(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] DELETE /api/v2/jim/scenario")
+
+	if apiv2.config.Scenario.Status() == nil {
+		w.WriteHeader(404)
+		return
+	}
+	apiv2.config.Scenario.Unload()
+}
+
+func (apiv2 *APIv2) startScenario(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] POST /api/v2/jim/scenario/start")
+
+	if err := apiv2.config.Scenario.Start(); err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	apiv2.writeScenarioStatus(w)
+}
+
+func (apiv2 *APIv2) stopScenario(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] POST /api/v2/jim/scenario/stop")
+
+	if apiv2.config.Scenario.Status() == nil {
+		w.WriteHeader(404)
+		return
+	}
+	apiv2.config.Scenario.Stop()
+	apiv2.writeScenarioStatus(w)
+}
+
+func (apiv2 *APIv2) activatePhase(w http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get(":name")
+	slog.Debug("[APIv2] POST /api/v2/jim/scenario/phases/{name}", "name", name)
+
+	if err := apiv2.config.Scenario.Activate(name); err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	apiv2.writeScenarioStatus(w)
+}
+
+func (apiv2 *APIv2) writeScenarioStatus(w http.ResponseWriter) {
+	b, _ := json.Marshal(apiv2.config.Scenario.Status())
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
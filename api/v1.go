@@ -1,8 +1,12 @@
 package api
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/smtp"
 	"strconv"
@@ -10,12 +14,11 @@ import (
 	"time"
 
 	"github.com/gorilla/pat"
-	"github.com/ian-kent/go-log/log"
+	"github.com/mailhog/MailHog-Server/auth"
 	"github.com/mailhog/MailHog-Server/config"
-	"github.com/mailhog/data"
+	"github.com/mailhog/MailHog-Server/metrics"
+	"github.com/mailhog/MailHog-Server/websockets"
 	"github.com/mailhog/storage"
-
-	"github.com/ian-kent/goose"
 )
 
 // APIv1 implements version 1 of the MailHog API
@@ -25,114 +28,160 @@ import (
 //
 // Any changes/additions should be added in APIv2.
 type APIv1 struct {
-	config      *config.Config
-	messageChan chan *data.Message
+	config *config.Config
+	wsHub  *websockets.Hub
 }
 
-// FIXME should probably move this into APIv1 struct
-var stream *goose.EventStream
+// keepaliveInterval is how often an empty keepalive event is sent to
+// event stream clients
+const keepaliveInterval = time.Minute
 
 // ReleaseConfig is an alias to preserve go package API
 type ReleaseConfig config.OutgoingSMTP
 
-func createAPIv1(conf *config.Config, r *pat.Router) *APIv1 {
-	log.Println("Creating API v1 with WebPath: " + conf.WebPath)
+func createAPIv1(conf *config.Config, r *pat.Router, wsHub *websockets.Hub) *APIv1 {
+	slog.Info("Creating API v1", "webpath", conf.WebPath)
 	apiv1 := &APIv1{
-		config:      conf,
-		messageChan: make(chan *data.Message),
+		config: conf,
+		wsHub:  wsHub,
 	}
 
-	stream = goose.NewEventStream()
-
-	r.Path(conf.WebPath + "/api/v1/messages").Methods("GET").HandlerFunc(apiv1.messages)
-	r.Path(conf.WebPath + "/api/v1/messages").Methods("DELETE").HandlerFunc(apiv1.delete_all)
-	r.Path(conf.WebPath + "/api/v1/messages").Methods("OPTIONS").HandlerFunc(apiv1.defaultOptions)
-
-	r.Path(conf.WebPath + "/api/v1/messages/{id}").Methods("GET").HandlerFunc(apiv1.message)
-	r.Path(conf.WebPath + "/api/v1/messages/{id}").Methods("DELETE").HandlerFunc(apiv1.delete_one)
-	r.Path(conf.WebPath + "/api/v1/messages/{id}").Methods("OPTIONS").HandlerFunc(apiv1.defaultOptions)
+	r.Path(conf.WebPath + "/api/v1/messages").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv1.messages))
+	r.Path(conf.WebPath + "/api/v1/messages").Methods("DELETE").HandlerFunc(auth.Require(auth.Delete, apiv1.delete_all))
 
-	r.Path(conf.WebPath + "/api/v1/messages/{id}/download").Methods("GET").HandlerFunc(apiv1.download)
-	r.Path(conf.WebPath + "/api/v1/messages/{id}/download").Methods("OPTIONS").HandlerFunc(apiv1.defaultOptions)
+	r.Path(conf.WebPath + "/api/v1/messages/{id}").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv1.message))
+	r.Path(conf.WebPath + "/api/v1/messages/{id}").Methods("DELETE").HandlerFunc(auth.Require(auth.Delete, apiv1.delete_one))
 
-	r.Path(conf.WebPath + "/api/v1/messages/{id}/mime/part/{part}/download").Methods("GET").HandlerFunc(apiv1.download_part)
-	r.Path(conf.WebPath + "/api/v1/messages/{id}/mime/part/{part}/download").Methods("OPTIONS").HandlerFunc(apiv1.defaultOptions)
+	r.Path(conf.WebPath + "/api/v1/messages/{id}/download").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv1.download))
 
-	r.Path(conf.WebPath + "/api/v1/messages/{id}/release").Methods("POST").HandlerFunc(apiv1.release_one)
-	r.Path(conf.WebPath + "/api/v1/messages/{id}/release").Methods("OPTIONS").HandlerFunc(apiv1.defaultOptions)
+	r.Path(conf.WebPath + "/api/v1/messages/{id}/mime/part/{part}/download").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv1.download_part))
 
-	r.Path(conf.WebPath + "/api/v1/events").Methods("GET").HandlerFunc(apiv1.eventstream)
-	r.Path(conf.WebPath + "/api/v1/events").Methods("OPTIONS").HandlerFunc(apiv1.defaultOptions)
+	r.Path(conf.WebPath + "/api/v1/messages/{id}/release").Methods("POST").HandlerFunc(auth.Require(auth.Release, apiv1.release_one))
 
-	go func() {
-		keepaliveTicker := time.Tick(time.Minute)
-		for {
-			select {
-			case msg := <-apiv1.messageChan:
-				log.Println("Got message in APIv1 event stream")
-				bytes, _ := json.MarshalIndent(msg, "", "  ")
-				json := string(bytes)
-				log.Printf("Sending content: %s\n", json)
-				apiv1.broadcast(json)
-			case <-keepaliveTicker:
-				apiv1.keepalive()
-			}
-		}
-	}()
+	r.Path(conf.WebPath + "/api/v1/events").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv1.eventstream))
 
 	return apiv1
 }
 
-func (apiv1 *APIv1) defaultOptions(w http.ResponseWriter, req *http.Request) {
-	if len(apiv1.config.CORSOrigin) > 0 {
-		w.Header().Add("Access-Control-Allow-Origin", apiv1.config.CORSOrigin)
-		w.Header().Add("Access-Control-Allow-Methods", "OPTIONS,GET,POST,DELETE")
-		w.Header().Add("Access-Control-Allow-Headers", "Content-Type")
-	}
-}
-
-func (apiv1 *APIv1) broadcast(json string) {
-	log.Println("[APIv1] BROADCAST /api/v1/events")
-	b := []byte(json)
-	stream.Notify("data", b)
-}
-
-// keepalive sends an empty keep alive message.
+// publish notifies event stream and websocket clients of an event.
 //
-// This not only can keep connections alive, but also will detect broken
-// connections. Without this it is possible for the server to become
-// unresponsive due to too many open files.
-func (apiv1 *APIv1) keepalive() {
-	log.Println("[APIv1] KEEPALIVE /api/v1/events")
-	stream.Notify("keepalive", []byte{})
+// Event stream clients receive e.Data with e.Type as the event name.
+func (apiv1 *APIv1) publish(e *websockets.Event) {
+	slog.Debug("[APIv1] PUBLISH /api/v1/events", "type", e.Type)
+	apiv1.wsHub.Publish(e)
 }
 
+// eventstream sends message events to the client as server-sent events
+//
+// Each event has its sequence number as its id. If the client reconnects
+// with a Last-Event-ID header, the events it missed are sent first.
 func (apiv1 *APIv1) eventstream(w http.ResponseWriter, req *http.Request) {
-	log.Println("[APIv1] GET /api/v1/events")
+	slog.Debug("[APIv1] GET /api/v1/events")
 
-	//apiv1.defaultOptions(session)
-	if len(apiv1.config.CORSOrigin) > 0 {
-		w.Header().Add("Access-Control-Allow-Origin", apiv1.config.CORSOrigin)
-		w.Header().Add("Access-Control-Allow-Methods", "OPTIONS,GET,POST,DELETE")
+	f, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+
+	var l *websockets.Listener
+	if id := req.Header.Get("Last-Event-ID"); len(id) > 0 {
+		seq, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		l = apiv1.wsHub.ListenSince(seq)
+	} else {
+		l = apiv1.wsHub.Listen()
 	}
+	defer apiv1.wsHub.Unlisten(l)
+
+	metrics.EventStreamListeners.Inc()
+	defer metrics.EventStreamListeners.Dec()
 
-	stream.AddReceiver(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(200)
+	f.Flush()
+
+	// keepalive sends an empty keep alive message.
+	//
+	// This not only can keep connections alive, but also will detect broken
+	// connections. Without this it is possible for the server to become
+	// unresponsive due to too many open files.
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		var err error
+		select {
+		case <-req.Context().Done():
+			return
+		case e, ok := <-l.C:
+			if !ok {
+				// the hub dropped us for falling behind, the client
+				// can reconnect with Last-Event-ID to catch up
+				return
+			}
+			err = writeEvent(w, e)
+		case <-keepalive.C:
+			slog.Debug("[APIv1] KEEPALIVE /api/v1/events")
+			_, err = io.WriteString(w, "event: keepalive\ndata: \n\n")
+		}
+		if err != nil {
+			return
+		}
+		f.Flush()
+	}
 }
 
-func (apiv1 *APIv1) messages(w http.ResponseWriter, req *http.Request) {
-	log.Println("[APIv1] GET /api/v1/messages")
+// writeEvent writes e to an event stream. New messages are sent as a
+// "data" event containing the message, other message events are sent
+// with their type as the event name.
+func writeEvent(w io.Writer, e *websockets.Event) error {
+	name := e.Type
+	var b []byte
+	switch e.Type {
+	case websockets.MessageCreated:
+		name = "data"
+		b, _ = json.MarshalIndent(e.Data, "", "  ")
+	case websockets.MessageDeleted, websockets.MessagesCleared, websockets.MessageReleased, websockets.HistoryTruncated:
+		b, _ = json.Marshal(e.Data)
+	default:
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if e.Seq > 0 {
+		fmt.Fprintf(&buf, "id: %d\n", e.Seq)
+	}
+	fmt.Fprintf(&buf, "event: %s\n", name)
+	for _, line := range strings.Split(string(b), "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
 
-	apiv1.defaultOptions(w, req)
+func (apiv1 *APIv1) messages(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv1] GET /api/v1/messages")
 
 	// TODO start, limit
 	switch apiv1.config.Storage.(type) {
 	case *storage.MongoDB:
+		t := metrics.TimeStorage("list")
 		messages, _ := apiv1.config.Storage.(*storage.MongoDB).List(0, 1000)
+		t.ObserveDuration()
 		bytes, _ := json.Marshal(messages)
 		w.Header().Add("Content-Type", "text/json")
 		w.Write(bytes)
 	case *storage.InMemory:
+		t := metrics.TimeStorage("list")
 		messages, _ := apiv1.config.Storage.(*storage.InMemory).List(0, 1000)
+		t.ObserveDuration()
 		bytes, _ := json.Marshal(messages)
 		w.Header().Add("Content-Type", "text/json")
 		w.Write(bytes)
@@ -143,20 +192,20 @@ func (apiv1 *APIv1) messages(w http.ResponseWriter, req *http.Request) {
 
 func (apiv1 *APIv1) message(w http.ResponseWriter, req *http.Request) {
 	id := req.URL.Query().Get(":id")
-	log.Printf("[APIv1] GET /api/v1/messages/%s\n", id)
-
-	apiv1.defaultOptions(w, req)
+	slog.Debug("[APIv1] GET /api/v1/messages/{id}", "id", id)
 
+	t := metrics.TimeStorage("load")
 	message, err := apiv1.config.Storage.Load(id)
+	t.ObserveDuration()
 	if err != nil {
-		log.Printf("- Error: %s", err)
+		slog.Error("Error loading message", "id", id, "error", err)
 		w.WriteHeader(500)
 		return
 	}
 
 	bytes, err := json.Marshal(message)
 	if err != nil {
-		log.Printf("- Error: %s", err)
+		slog.Error("Error encoding message", "id", id, "error", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -167,16 +216,16 @@ func (apiv1 *APIv1) message(w http.ResponseWriter, req *http.Request) {
 
 func (apiv1 *APIv1) download(w http.ResponseWriter, req *http.Request) {
 	id := req.URL.Query().Get(":id")
-	log.Printf("[APIv1] GET /api/v1/messages/%s\n", id)
-
-	apiv1.defaultOptions(w, req)
+	slog.Debug("[APIv1] GET /api/v1/messages/{id}/download", "id", id)
 
 	w.Header().Set("Content-Type", "message/rfc822")
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+id+".eml\"")
 
 	switch apiv1.config.Storage.(type) {
 	case *storage.MongoDB:
+		t := metrics.TimeStorage("load")
 		message, _ := apiv1.config.Storage.(*storage.MongoDB).Load(id)
+		t.ObserveDuration()
 		for h, l := range message.Content.Headers {
 			for _, v := range l {
 				w.Write([]byte(h + ": " + v + "\r\n"))
@@ -184,7 +233,9 @@ func (apiv1 *APIv1) download(w http.ResponseWriter, req *http.Request) {
 		}
 		w.Write([]byte("\r\n" + message.Content.Body))
 	case *storage.InMemory:
+		t := metrics.TimeStorage("load")
 		message, _ := apiv1.config.Storage.(*storage.InMemory).Load(id)
+		t.ObserveDuration()
 		for h, l := range message.Content.Headers {
 			for _, v := range l {
 				w.Write([]byte(h + ": " + v + "\r\n"))
@@ -199,14 +250,15 @@ func (apiv1 *APIv1) download(w http.ResponseWriter, req *http.Request) {
 func (apiv1 *APIv1) download_part(w http.ResponseWriter, req *http.Request) {
 	id := req.URL.Query().Get(":id")
 	part := req.URL.Query().Get(":part")
-	log.Printf("[APIv1] GET /api/v1/messages/%s/mime/part/%s/download\n", id, part)
+	slog.Debug("[APIv1] GET /api/v1/messages/{id}/mime/part/{part}/download", "id", id, "part", part)
 
 	// TODO extension from content-type?
-	apiv1.defaultOptions(w, req)
 
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+id+"-part-"+part+"\"")
 
+	t := metrics.TimeStorage("load")
 	message, _ := apiv1.config.Storage.Load(id)
+	t.ObserveDuration()
 	contentTransferEncoding := ""
 	pid, _ := strconv.Atoi(part)
 	for h, l := range message.MIME.Parts[pid].Headers {
@@ -230,66 +282,66 @@ func (apiv1 *APIv1) download_part(w http.ResponseWriter, req *http.Request) {
 		var e error
 		body, e = base64.StdEncoding.DecodeString(message.MIME.Parts[pid].Body)
 		if e != nil {
-			log.Printf("[APIv1] Decoding base64 encoded body failed: %s", e)
+			slog.Error("[APIv1] Decoding base64 encoded body failed", "id", id, "part", part, "error", e)
 		}
 	}
 	w.Write(body)
 }
 
 func (apiv1 *APIv1) delete_all(w http.ResponseWriter, req *http.Request) {
-	log.Println("[APIv1] POST /api/v1/messages")
-
-	apiv1.defaultOptions(w, req)
+	slog.Debug("[APIv1] DELETE /api/v1/messages")
 
 	w.Header().Add("Content-Type", "text/json")
 
+	t := metrics.TimeStorage("delete_all")
 	err := apiv1.config.Storage.DeleteAll()
+	t.ObserveDuration()
 	if err != nil {
-		log.Println(err)
+		slog.Error("Error deleting messages", "error", err)
 		w.WriteHeader(500)
 		return
 	}
+	apiv1.config.Transcripts.DeleteAll()
+	apiv1.publish(&websockets.Event{Type: websockets.MessagesCleared})
 
 	w.WriteHeader(200)
 }
 
 func (apiv1 *APIv1) release_one(w http.ResponseWriter, req *http.Request) {
 	id := req.URL.Query().Get(":id")
-	log.Printf("[APIv1] POST /api/v1/messages/%s/release\n", id)
-
-	apiv1.defaultOptions(w, req)
+	slog.Debug("[APIv1] POST /api/v1/messages/{id}/release", "id", id)
 
 	w.Header().Add("Content-Type", "text/json")
+	t := metrics.TimeStorage("load")
 	msg, _ := apiv1.config.Storage.Load(id)
+	t.ObserveDuration()
 
 	decoder := json.NewDecoder(req.Body)
 	var cfg ReleaseConfig
 	err := decoder.Decode(&cfg)
 	if err != nil {
-		log.Printf("Error decoding request body: %s", err)
+		slog.Error("Error decoding request body", "error", err)
 		w.WriteHeader(500)
 		w.Write([]byte("Error decoding request body"))
 		return
 	}
 
-	log.Printf("%+v", cfg)
-
-	log.Printf("Got message: %s", msg.ID)
+	slog.Debug("Got message", "id", msg.ID)
 
 	if cfg.Save {
 		if _, ok := apiv1.config.OutgoingSMTP[cfg.Name]; ok {
-			log.Printf("Server already exists named %s", cfg.Name)
+			slog.Warn("Server already exists", "name", cfg.Name)
 			w.WriteHeader(400)
 			return
 		}
 		cf := config.OutgoingSMTP(cfg)
 		apiv1.config.OutgoingSMTP[cfg.Name] = &cf
-		log.Printf("Saved server with name %s", cfg.Name)
+		slog.Info("Saved server", "name", cfg.Name)
 	}
 
 	if len(cfg.Name) > 0 {
 		if c, ok := apiv1.config.OutgoingSMTP[cfg.Name]; ok {
-			log.Printf("Using server with name: %s", cfg.Name)
+			slog.Debug("Using server", "name", cfg.Name)
 			cfg.Name = c.Name
 			if len(cfg.Email) == 0 {
 				cfg.Email = c.Email
@@ -300,13 +352,13 @@ func (apiv1 *APIv1) release_one(w http.ResponseWriter, req *http.Request) {
 			cfg.Password = c.Password
 			cfg.Mechanism = c.Mechanism
 		} else {
-			log.Printf("Server not found: %s", cfg.Name)
+			slog.Warn("Server not found", "name", cfg.Name)
 			w.WriteHeader(400)
 			return
 		}
 	}
 
-	log.Printf("Releasing to %s (via %s:%s)", cfg.Email, cfg.Host, cfg.Port)
+	slog.Info("Releasing message", "id", msg.ID, "to", cfg.Email, "host", cfg.Host, "port", cfg.Port)
 
 	bytes := make([]byte, 0)
 	for h, l := range msg.Content.Headers {
@@ -319,14 +371,14 @@ func (apiv1 *APIv1) release_one(w http.ResponseWriter, req *http.Request) {
 	var auth smtp.Auth
 
 	if len(cfg.Username) > 0 || len(cfg.Password) > 0 {
-		log.Printf("Found username/password, using auth mechanism: [%s]", cfg.Mechanism)
+		slog.Debug("Found username/password", "mechanism", cfg.Mechanism)
 		switch cfg.Mechanism {
 		case "CRAMMD5":
 			auth = smtp.CRAMMD5Auth(cfg.Username, cfg.Password)
 		case "PLAIN":
 			auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
 		default:
-			log.Printf("Error - invalid authentication mechanism")
+			slog.Warn("Invalid authentication mechanism", "mechanism", cfg.Mechanism)
 			w.WriteHeader(400)
 			return
 		}
@@ -334,26 +386,40 @@ func (apiv1 *APIv1) release_one(w http.ResponseWriter, req *http.Request) {
 
 	err = smtp.SendMail(cfg.Host+":"+cfg.Port, auth, "nobody@"+apiv1.config.Hostname, []string{cfg.Email}, bytes)
 	if err != nil {
-		log.Printf("Failed to release message: %s", err)
+		metrics.Releases.WithLabelValues("failed").Inc()
+		slog.Error("Failed to release message", "id", msg.ID, "error", err)
 		w.WriteHeader(500)
 		return
 	}
-	log.Printf("Message released successfully")
+	metrics.Releases.WithLabelValues("sent").Inc()
+	slog.Info("Message released successfully", "id", msg.ID)
+	apiv1.publish(&websockets.Event{
+		Type:    websockets.MessageReleased,
+		Data:    map[string]string{"id": id, "email": cfg.Email, "host": cfg.Host, "port": cfg.Port},
+		Message: msg,
+	})
 }
 
 func (apiv1 *APIv1) delete_one(w http.ResponseWriter, req *http.Request) {
 	id := req.URL.Query().Get(":id")
 
-	log.Printf("[APIv1] POST /api/v1/messages/%s/delete\n", id)
-
-	apiv1.defaultOptions(w, req)
+	slog.Debug("[APIv1] DELETE /api/v1/messages/{id}", "id", id)
 
 	w.Header().Add("Content-Type", "text/json")
+	msg, _ := apiv1.config.Storage.Load(id)
+	t := metrics.TimeStorage("delete_one")
 	err := apiv1.config.Storage.DeleteOne(id)
+	t.ObserveDuration()
 	if err != nil {
-		log.Println(err)
+		slog.Error("Error deleting message", "id", id, "error", err)
 		w.WriteHeader(500)
 		return
 	}
+	apiv1.config.Transcripts.Delete(id)
+	apiv1.publish(&websockets.Event{
+		Type:    websockets.MessageDeleted,
+		Data:    map[string]string{"id": id},
+		Message: msg,
+	})
 	w.WriteHeader(200)
 }
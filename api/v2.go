@@ -2,12 +2,17 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
 
 	"github.com/gorilla/pat"
-	"github.com/ian-kent/go-log/log"
+	"github.com/mailhog/MailHog-Server/auth"
 	"github.com/mailhog/MailHog-Server/config"
+	"github.com/mailhog/MailHog-Server/health"
+	"github.com/mailhog/MailHog-Server/metrics"
 	"github.com/mailhog/MailHog-Server/monkey"
 	"github.com/mailhog/MailHog-Server/websockets"
 	"github.com/mailhog/data"
@@ -19,40 +24,83 @@ import (
 // Use APIv1 for guaranteed compatibility.
 type APIv2 struct {
 	config      *config.Config
-	messageChan chan *data.Message
+	messageChan <-chan *data.Message
 	wsHub       *websockets.Hub
 }
 
-func createAPIv2(conf *config.Config, r *pat.Router) *APIv2 {
-	log.Println("Creating API v2 with WebPath: " + conf.WebPath)
+func createAPIv2(conf *config.Config, r *pat.Router, wsHub *websockets.Hub) *APIv2 {
+	slog.Info("Creating API v2", "webpath", conf.WebPath)
 	apiv2 := &APIv2{
 		config:      conf,
-		messageChan: make(chan *data.Message),
-		wsHub:       websockets.NewHub(),
+		messageChan: conf.Bus.Subscribe("apiv2", conf.BusBuffer).C,
+		wsHub:       wsHub,
 	}
 
-	r.Path(conf.WebPath + "/api/v2/messages").Methods("GET").HandlerFunc(apiv2.messages)
-	r.Path(conf.WebPath + "/api/v2/messages").Methods("OPTIONS").HandlerFunc(apiv2.defaultOptions)
+	conf.MonkeyStats.Notify(func(d monkey.Decision) {
+		wsHub.Notify(&websockets.Event{Type: websockets.JimDecision, Data: d})
+	})
+	conf.Scenario.Notify(func(s *monkey.ScenarioStatus) {
+		wsHub.Publish(&websockets.Event{Type: websockets.ScenarioChanged, Data: s})
+	})
 
-	r.Path(conf.WebPath + "/api/v2/search").Methods("GET").HandlerFunc(apiv2.search)
-	r.Path(conf.WebPath + "/api/v2/search").Methods("OPTIONS").HandlerFunc(apiv2.defaultOptions)
+	r.Path(conf.WebPath + "/api/v2/messages").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv2.messages))
 
-	r.Path(conf.WebPath + "/api/v2/jim").Methods("GET").HandlerFunc(apiv2.jim)
-	r.Path(conf.WebPath + "/api/v2/jim").Methods("POST").HandlerFunc(apiv2.createJim)
-	r.Path(conf.WebPath + "/api/v2/jim").Methods("PUT").HandlerFunc(apiv2.updateJim)
-	r.Path(conf.WebPath + "/api/v2/jim").Methods("DELETE").HandlerFunc(apiv2.deleteJim)
-	r.Path(conf.WebPath + "/api/v2/jim").Methods("OPTIONS").HandlerFunc(apiv2.defaultOptions)
+	r.Path(conf.WebPath + "/api/v2/messages/{id}/transcript").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv2.transcript))
 
-	r.Path(conf.WebPath + "/api/v2/outgoing-smtp").Methods("GET").HandlerFunc(apiv2.listOutgoingSMTP)
-	r.Path(conf.WebPath + "/api/v2/outgoing-smtp").Methods("OPTIONS").HandlerFunc(apiv2.defaultOptions)
+	r.Path(conf.WebPath + "/api/v2/sessions").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv2.sessions))
 
-	r.Path(conf.WebPath + "/api/v2/websocket").Methods("GET").HandlerFunc(apiv2.websocket)
+	r.Path(conf.WebPath + "/api/v2/search").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv2.search))
 
+	r.Path(conf.WebPath + "/api/v2/jim").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv2.jim))
+	r.Path(conf.WebPath + "/api/v2/jim").Methods("POST").HandlerFunc(auth.Require(auth.Admin, apiv2.createJim))
+	r.Path(conf.WebPath + "/api/v2/jim").Methods("PUT").HandlerFunc(auth.Require(auth.Admin, apiv2.updateJim))
+	r.Path(conf.WebPath + "/api/v2/jim").Methods("DELETE").HandlerFunc(auth.Require(auth.Admin, apiv2.deleteJim))
+
+	r.Path(conf.WebPath + "/api/v2/jim/stats").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv2.jimStats))
+	r.Path(conf.WebPath + "/api/v2/jim/stats").Methods("DELETE").HandlerFunc(auth.Require(auth.Admin, apiv2.resetJimStats))
+
+	r.Path(conf.WebPath + "/api/v2/jim/scenario").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv2.scenario))
+	r.Path(conf.WebPath + "/api/v2/jim/scenario").Methods("PUT").HandlerFunc(auth.Require(auth.Admin, apiv2.loadScenario))
+	r.Path(conf.WebPath + "/api/v2/jim/scenario").Methods("DELETE").HandlerFunc(auth.Require(auth.Admin, apiv2.unloadScenario))
+	r.Path(conf.WebPath + "/api/v2/jim/scenario/start").Methods("POST").HandlerFunc(auth.Require(auth.Admin, apiv2.startScenario))
+	r.Path(conf.WebPath + "/api/v2/jim/scenario/stop").Methods("POST").HandlerFunc(auth.Require(auth.Admin, apiv2.stopScenario))
+	r.Path(conf.WebPath + "/api/v2/jim/scenario/phases/{name}").Methods("POST").HandlerFunc(auth.Require(auth.Admin, apiv2.activatePhase))
+
+	r.Path(conf.WebPath + "/api/v2/chaos/rules").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv2.listRules))
+	r.Path(conf.WebPath + "/api/v2/chaos/rules").Methods("PUT").HandlerFunc(auth.Require(auth.Admin, apiv2.replaceRules))
+	r.Path(conf.WebPath + "/api/v2/chaos/rules").Methods("POST").HandlerFunc(auth.Require(auth.Admin, apiv2.createRule))
+
+	r.Path(conf.WebPath + "/api/v2/chaos/rules/{id}").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv2.rule))
+	r.Path(conf.WebPath + "/api/v2/chaos/rules/{id}").Methods("PUT").HandlerFunc(auth.Require(auth.Admin, apiv2.updateRule))
+	r.Path(conf.WebPath + "/api/v2/chaos/rules/{id}").Methods("DELETE").HandlerFunc(auth.Require(auth.Admin, apiv2.deleteRule))
+
+	r.Path(conf.WebPath + "/api/v2/outgoing-smtp").Methods("GET").HandlerFunc(auth.Require(auth.Release, apiv2.listOutgoingSMTP))
+
+	r.Path(conf.WebPath + "/api/v2/webhooks").Methods("GET").HandlerFunc(auth.Require(auth.Admin, apiv2.listWebhooks))
+	r.Path(conf.WebPath + "/api/v2/webhooks").Methods("POST").HandlerFunc(auth.Require(auth.Admin, apiv2.createWebhook))
+
+	r.Path(conf.WebPath + "/api/v2/webhooks/{id}").Methods("GET").HandlerFunc(auth.Require(auth.Admin, apiv2.webhook))
+	r.Path(conf.WebPath + "/api/v2/webhooks/{id}").Methods("PUT").HandlerFunc(auth.Require(auth.Admin, apiv2.updateWebhook))
+	r.Path(conf.WebPath + "/api/v2/webhooks/{id}").Methods("DELETE").HandlerFunc(auth.Require(auth.Admin, apiv2.deleteWebhook))
+
+	r.Path(conf.WebPath + "/api/v2/webhooks/{id}/attempts").Methods("GET").HandlerFunc(auth.Require(auth.Admin, apiv2.webhookAttempts))
+
+	r.Path(conf.WebPath + "/api/v2/dead-letters").Methods("GET").HandlerFunc(auth.Require(auth.Admin, apiv2.deadLetters))
+	r.Path(conf.WebPath + "/api/v2/dead-letters").Methods("DELETE").HandlerFunc(auth.Require(auth.Admin, apiv2.clearDeadLetters))
+
+	r.Path(conf.WebPath + "/api/v2/dead-letters/{id}/retry").Methods("POST").HandlerFunc(auth.Require(auth.Admin, apiv2.retryDeadLetter))
+
+	r.Path(conf.WebPath + "/api/v2/websocket").Methods("GET").HandlerFunc(auth.Require(auth.Read, apiv2.websocket))
+
+	consumer := health.NewFlag("API v2 message consumer not running")
+	health.Register("apiv2", consumer.Check)
 	go func() {
+		consumer.Set(true)
+		defer consumer.Set(false)
 		for {
 			select {
 			case msg := <-apiv2.messageChan:
-				log.Println("Got message in APIv2 websocket channel")
+				slog.Debug("Got message in APIv2 websocket channel", "id", msg.ID)
 				apiv2.broadcast(msg)
 			}
 		}
@@ -61,14 +109,6 @@ func createAPIv2(conf *config.Config, r *pat.Router) *APIv2 {
 	return apiv2
 }
 
-func (apiv2 *APIv2) defaultOptions(w http.ResponseWriter, req *http.Request) {
-	if len(apiv2.config.CORSOrigin) > 0 {
-		w.Header().Add("Access-Control-Allow-Origin", apiv2.config.CORSOrigin)
-		w.Header().Add("Access-Control-Allow-Methods", "OPTIONS,GET,PUT,POST,DELETE")
-		w.Header().Add("Access-Control-Allow-Headers", "Content-Type")
-	}
-}
-
 type messagesResult struct {
 	Total int            `json:"total"`
 	Count int            `json:"count"`
@@ -97,15 +137,15 @@ func (apiv2 *APIv2) getStartLimit(w http.ResponseWriter, req *http.Request) (sta
 }
 
 func (apiv2 *APIv2) messages(w http.ResponseWriter, req *http.Request) {
-	log.Println("[APIv2] GET /api/v2/messages")
-
-	apiv2.defaultOptions(w, req)
+	slog.Debug("[APIv2] GET /api/v2/messages")
 
 	start, limit := apiv2.getStartLimit(w, req)
 
 	var res messagesResult
 
+	t := metrics.TimeStorage("list")
 	messages, err := apiv2.config.Storage.List(start, limit)
+	t.ObserveDuration()
 	if err != nil {
 		panic(err)
 	}
@@ -113,17 +153,40 @@ func (apiv2 *APIv2) messages(w http.ResponseWriter, req *http.Request) {
 	res.Count = len([]data.Message(*messages))
 	res.Start = start
 	res.Items = []data.Message(*messages)
+	t = metrics.TimeStorage("count")
 	res.Total = apiv2.config.Storage.Count()
+	t.ObserveDuration()
 
 	bytes, _ := json.Marshal(res)
 	w.Header().Add("Content-Type", "text/json")
 	w.Write(bytes)
 }
 
-func (apiv2 *APIv2) search(w http.ResponseWriter, req *http.Request) {
-	log.Println("[APIv2] GET /api/v2/search")
+func (apiv2 *APIv2) transcript(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	slog.Debug("[APIv2] GET /api/v2/messages/{id}/transcript", "id", id)
 
-	apiv2.defaultOptions(w, req)
+	t, ok := apiv2.config.Transcripts.Message(id)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+
+	b, _ := json.Marshal(t)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) sessions(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] GET /api/v2/sessions")
+
+	b, _ := json.Marshal(apiv2.config.Transcripts.Sessions())
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) search(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] GET /api/v2/search")
 
 	start, limit := apiv2.getStartLimit(w, req)
 
@@ -141,7 +204,9 @@ func (apiv2 *APIv2) search(w http.ResponseWriter, req *http.Request) {
 
 	var res messagesResult
 
+	t := metrics.TimeStorage("search")
 	messages, total, _ := apiv2.config.Storage.Search(kind, query, start, limit)
+	t.ObserveDuration()
 
 	res.Count = len([]data.Message(*messages))
 	res.Start = start
@@ -153,92 +218,162 @@ func (apiv2 *APIv2) search(w http.ResponseWriter, req *http.Request) {
 	w.Write(b)
 }
 
-func (apiv2 *APIv2) jim(w http.ResponseWriter, req *http.Request) {
-	log.Println("[APIv2] GET /api/v2/jim")
-
-	apiv2.defaultOptions(w, req)
+// errJimInvited and errJimNotInvited are returned by Jim config updates
+// which conflict with whether he's invited
+var (
+	errJimInvited    = errors.New("Jim is already invited")
+	errJimNotInvited = errors.New("Jim isn't invited")
+)
 
-	if apiv2.config.Monkey == nil {
+func (apiv2 *APIv2) jim(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] GET /api/v2/jim")
+
+	// while a scenario is loaded Jim is reported with its status, and
+	// with the settings of the active phase if it changes them
+	v := apiv2.config.Monkey.Load()
+	scenario := apiv2.config.Scenario.Status()
+	m := v.Monkey()
+	if p := apiv2.config.Scenario.Current(); p != nil && p.Monkey() != nil {
+		m = p.Monkey()
+	}
+	if m == nil && scenario == nil {
 		w.WriteHeader(404)
 		return
 	}
 
-	b, _ := json.Marshal(apiv2.config.Monkey)
+	jim, _ := m.(*monkey.Jim)
+	b, _ := json.Marshal(struct {
+		*monkey.Jim
+		Version  uint64
+		Scenario *monkey.ScenarioStatus `json:",omitempty"`
+	}{jim, v.Version, scenario})
 	w.Header().Add("Content-Type", "application/json")
 	w.Write(b)
 }
 
 func (apiv2 *APIv2) deleteJim(w http.ResponseWriter, req *http.Request) {
-	log.Println("[APIv2] DELETE /api/v2/jim")
-
-	apiv2.defaultOptions(w, req)
+	slog.Debug("[APIv2] DELETE /api/v2/jim")
 
-	if apiv2.config.Monkey == nil {
+	v, err := apiv2.config.Monkey.Update(func(v *monkey.Version) error {
+		if !v.Enabled {
+			return errJimNotInvited
+		}
+		v.Enabled, v.Live = false, liveChange(req)
+		return nil
+	})
+	if err != nil {
 		w.WriteHeader(404)
 		return
 	}
 
-	apiv2.config.Monkey = nil
+	apiv2.wsHub.Publish(&websockets.Event{Type: websockets.JimChanged})
+	apiv2.writeJimVersion(w, 200, v)
 }
 
 func (apiv2 *APIv2) createJim(w http.ResponseWriter, req *http.Request) {
-	log.Println("[APIv2] POST /api/v2/jim")
+	slog.Debug("[APIv2] POST /api/v2/jim")
 
-	apiv2.defaultOptions(w, req)
-
-	if apiv2.config.Monkey != nil {
+	// without a body Jim is invited back with his previous settings
+	jim, err := jimFromBody(req, true)
+	if err != nil {
 		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
 		return
 	}
 
-	apiv2.config.Monkey = config.Jim
-
-	// Try, but ignore errors
-	// Could be better (e.g., ok if no json, error if badly formed json)
-	// but this works for now
-	apiv2.newJimFromBody(w, req)
+	v, err := apiv2.config.Monkey.Update(func(v *monkey.Version) error {
+		if v.Enabled {
+			return errJimInvited
+		}
+		if jim != nil {
+			jim.ConfigureFrom(v.Jim)
+			v.Jim = jim
+		}
+		v.Enabled, v.Live = true, liveChange(req)
+		return nil
+	})
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
-	w.WriteHeader(201)
+	apiv2.wsHub.Publish(&websockets.Event{Type: websockets.JimChanged, Data: v.Jim})
+	apiv2.writeJimVersion(w, 201, v)
 }
 
-func (apiv2 *APIv2) newJimFromBody(w http.ResponseWriter, req *http.Request) error {
-	var jim monkey.Jim
+func (apiv2 *APIv2) updateJim(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] PUT /api/v2/jim")
 
-	dec := json.NewDecoder(req.Body)
-	err := dec.Decode(&jim)
+	jim, err := jimFromBody(req, false)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
+	v, err := apiv2.config.Monkey.Update(func(v *monkey.Version) error {
+		if !v.Enabled {
+			return errJimNotInvited
+		}
+		jim.ConfigureFrom(v.Jim)
+		v.Jim, v.Live = jim, liveChange(req)
+		return nil
+	})
 	if err != nil {
-		return err
+		w.WriteHeader(404)
+		return
 	}
 
-	jim.ConfigureFrom(config.Jim)
+	apiv2.wsHub.Publish(&websockets.Event{Type: websockets.JimChanged, Data: v.Jim})
+	apiv2.writeJimVersion(w, 200, v)
+}
 
-	config.Jim = &jim
-	apiv2.config.Monkey = &jim
+// jimFromBody reads and validates Jim's settings from the request body.
+// If optional is true an empty body returns nil.
+func jimFromBody(req *http.Request, optional bool) (*monkey.Jim, error) {
+	var jim monkey.Jim
+	if err := json.NewDecoder(req.Body).Decode(&jim); err != nil {
+		if err == io.EOF && optional {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := jim.Validate(); err != nil {
+		return nil, err
+	}
+	return &jim, nil
+}
 
-	return nil
+// liveChange returns true if a change to Jim should apply to sessions in
+// progress, rather than only new sessions
+func liveChange(req *http.Request) bool {
+	return req.URL.Query().Get("live") == "true"
 }
 
-func (apiv2 *APIv2) updateJim(w http.ResponseWriter, req *http.Request) {
-	log.Println("[APIv2] PUT /api/v2/jim")
+func (apiv2 *APIv2) writeJimVersion(w http.ResponseWriter, code int, v *monkey.Version) {
+	b, _ := json.Marshal(v)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
 
-	apiv2.defaultOptions(w, req)
+func (apiv2 *APIv2) jimStats(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] GET /api/v2/jim/stats")
 
-	if apiv2.config.Monkey == nil {
-		w.WriteHeader(404)
-		return
-	}
+	b, _ := json.Marshal(apiv2.config.MonkeyStats.Report())
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
 
-	err := apiv2.newJimFromBody(w, req)
-	if err != nil {
-		w.WriteHeader(400)
-	}
+func (apiv2 *APIv2) resetJimStats(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] DELETE /api/v2/jim/stats")
+
+	apiv2.config.MonkeyStats.Reset()
 }
 
 func (apiv2 *APIv2) listOutgoingSMTP(w http.ResponseWriter, req *http.Request) {
-	log.Println("[APIv2] GET /api/v2/outgoing-smtp")
-
-	apiv2.defaultOptions(w, req)
+	slog.Debug("[APIv2] GET /api/v2/outgoing-smtp")
 
 	b, _ := json.Marshal(apiv2.config.OutgoingSMTP)
 	w.Header().Add("Content-Type", "application/json")
@@ -246,13 +381,13 @@ func (apiv2 *APIv2) listOutgoingSMTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func (apiv2 *APIv2) websocket(w http.ResponseWriter, req *http.Request) {
-	log.Println("[APIv2] GET /api/v2/websocket")
+	slog.Debug("[APIv2] GET /api/v2/websocket")
 
 	apiv2.wsHub.Serve(w, req)
 }
 
 func (apiv2 *APIv2) broadcast(msg *data.Message) {
-	log.Println("[APIv2] BROADCAST /api/v2/websocket")
+	slog.Debug("[APIv2] BROADCAST /api/v2/websocket")
 
-	apiv2.wsHub.Broadcast(msg)
+	apiv2.wsHub.Publish(&websockets.Event{Type: websockets.MessageCreated, Data: msg, Message: msg})
 }
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/mailhog/MailHog-Server/webhooks"
+)
+
+func (apiv2 *APIv2) listWebhooks(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] GET /api/v2/webhooks")
+
+	hooks := make([]*webhooks.Webhook, 0)
+	for _, h := range apiv2.config.Webhooks.List() {
+		hooks = append(hooks, h.Redacted())
+	}
+
+	b, _ := json.Marshal(hooks)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) webhook(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	slog.Debug("[APIv2] GET /api/v2/webhooks/{id}", "id", id)
+
+	h, ok := apiv2.config.Webhooks.Get(id)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+
+	b, _ := json.Marshal(h.Redacted())
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) createWebhook(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] POST /api/v2/webhooks")
+
+	var h webhooks.Webhook
+	if err := json.NewDecoder(req.Body).Decode(&h); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	h.ID = ""
+
+	if err := apiv2.config.Webhooks.Add(&h); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	b, _ := json.Marshal(h.Redacted())
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(201)
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) updateWebhook(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	slog.Debug("[APIv2] PUT /api/v2/webhooks/{id}", "id", id)
+
+	var h webhooks.Webhook
+	if err := json.NewDecoder(req.Body).Decode(&h); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	err := apiv2.config.Webhooks.Update(id, &h)
+	if err == webhooks.ErrNotFound {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	b, _ := json.Marshal(h.Redacted())
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) deleteWebhook(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	slog.Debug("[APIv2] DELETE /api/v2/webhooks/{id}", "id", id)
+
+	if err := apiv2.config.Webhooks.Remove(id); err != nil {
+		w.WriteHeader(404)
+	}
+}
+
+func (apiv2 *APIv2) webhookAttempts(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	slog.Debug("[APIv2] GET /api/v2/webhooks/{id}/attempts", "id", id)
+
+	b, _ := json.Marshal(apiv2.config.Webhooks.Attempts(id))
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) deadLetters(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] GET /api/v2/dead-letters")
+
+	b, _ := json.Marshal(apiv2.config.Webhooks.DeadLetters())
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (apiv2 *APIv2) clearDeadLetters(w http.ResponseWriter, req *http.Request) {
+	slog.Debug("[APIv2] DELETE /api/v2/dead-letters")
+
+	apiv2.config.Webhooks.ClearDeadLetters()
+}
+
+func (apiv2 *APIv2) retryDeadLetter(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	slog.Debug("[APIv2] POST /api/v2/dead-letters/{id}/retry", "id", id)
+
+	if err := apiv2.config.Webhooks.Retry(id); err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.WriteHeader(202)
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	mhhttp "github.com/mailhog/http"
+)
+
+// TokenProtocolPrefix is the prefix of the websocket subprotocol used to
+// pass an API token, since browsers can't set headers on websocket
+// connections
+const TokenProtocolPrefix = "mailhog.token."
+
+// Tokens are API tokens accepted as an alternative to basic auth
+var Tokens []*Token
+
+type contextKey struct{}
+
+// Enabled returns true if the API requires credentials
+func Enabled() bool {
+	return mhhttp.Authorised != nil || len(Tokens) > 0
+}
+
+// Authorised returns true if r has valid credentials, or if the API
+// doesn't require any
+func Authorised(r *http.Request) bool {
+	_, ok := scopes(r)
+	return ok
+}
+
+// Allowed returns true if r has valid credentials granting scope, or if
+// the API doesn't require any
+func Allowed(r *http.Request, scope Scope) bool {
+	s, ok := scopes(r)
+	return ok && s.Has(scope)
+}
+
+// scopes returns the scopes granted to r, and false if it doesn't have
+// valid credentials. Basic auth users are granted every scope.
+func scopes(r *http.Request) (Scopes, bool) {
+	if s, ok := r.Context().Value(contextKey{}).(Scopes); ok {
+		return s, true
+	}
+	if !Enabled() {
+		return AllScopes, true
+	}
+	if user, pass, ok := r.BasicAuth(); ok && mhhttp.Authorised != nil && mhhttp.Authorised(user, pass) {
+		return AllScopes, true
+	}
+	if token := RequestToken(r); len(token) > 0 {
+		for _, t := range Tokens {
+			if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+				return t.Scopes, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// RequestToken returns the API token sent with r, from either a bearer
+// Authorization header, the access_token query parameter or a websocket
+// subprotocol prefixed with TokenProtocolPrefix
+func RequestToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	if t := r.URL.Query().Get("access_token"); len(t) > 0 {
+		return t
+	}
+	for _, p := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(p, TokenProtocolPrefix) {
+			return strings.TrimPrefix(p, TokenProtocolPrefix)
+		}
+	}
+	return ""
+}
+
+// Handler requires valid credentials for requests to h, except for the
+// public paths, e.g. health checks. The scopes they grant are checked by
+// Require.
+//
+// CORS preflight requests are never sent with credentials, so OPTIONS
+// requests are passed through.
+func Handler(h http.Handler, public ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		for _, p := range public {
+			if r.URL.Path == p {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		s, ok := scopes(r)
+		if !ok {
+			unauthorised(w)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, s)))
+	})
+}
+
+// Require wraps h to check its requests have credentials granting scope
+func Require(scope Scope, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := scopes(r)
+		if !ok {
+			unauthorised(w)
+			return
+		}
+		if !s.Has(scope) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("token requires scope: " + string(scope)))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func unauthorised(w http.ResponseWriter) {
+	if mhhttp.Authorised != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="MailHog"`)
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	mhhttp "github.com/mailhog/http"
+)
+
+func TestAuthorised(t *testing.T) {
+	Convey("Requests are authorised if no credentials are configured", t, func() {
+		r := httptest.NewRequest("GET", "/api/v2/messages", nil)
+		So(Authorised(r), ShouldBeTrue)
+	})
+
+	Convey("Requests need basic auth credentials or a token", t, func() {
+		Tokens = []*Token{{Token: "secret", Scopes: AllScopes}}
+		mhhttp.Authorised = func(user, pass string) bool { return user == "test" && pass == "pass" }
+		defer func() {
+			Tokens = nil
+			mhhttp.Authorised = nil
+		}()
+
+		r := httptest.NewRequest("GET", "/api/v2/websocket", nil)
+		So(Authorised(r), ShouldBeFalse)
+
+		r.SetBasicAuth("test", "pass")
+		So(Authorised(r), ShouldBeTrue)
+		r.SetBasicAuth("test", "wrong")
+		So(Authorised(r), ShouldBeFalse)
+
+		r = httptest.NewRequest("GET", "/api/v2/websocket?access_token=secret", nil)
+		So(Authorised(r), ShouldBeTrue)
+		r = httptest.NewRequest("GET", "/api/v2/websocket?access_token=wrong", nil)
+		So(Authorised(r), ShouldBeFalse)
+
+		r = httptest.NewRequest("GET", "/api/v2/websocket", nil)
+		r.Header.Set("Sec-WebSocket-Protocol", "mailhog, "+TokenProtocolPrefix+"secret")
+		So(Authorised(r), ShouldBeTrue)
+
+		r = httptest.NewRequest("GET", "/api/v2/messages", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		So(Authorised(r), ShouldBeTrue)
+
+		h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/messages", nil))
+		So(w.Code, ShouldEqual, 401)
+		So(w.Header().Get("WWW-Authenticate"), ShouldNotBeEmpty)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/api/v2/messages", nil))
+		So(w.Code, ShouldEqual, 200)
+
+		h = Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "/healthz")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+		So(w.Code, ShouldEqual, 200)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz/x", nil))
+		So(w.Code, ShouldEqual, 401)
+	})
+}
+
+func TestRequire(t *testing.T) {
+	Convey("Require should check the token's scopes", t, func() {
+		Tokens, _ = ParseTokens("reader:read,admin")
+		defer func() { Tokens = nil }()
+
+		h := Handler(Require(Delete, func(w http.ResponseWriter, r *http.Request) {}))
+
+		r := httptest.NewRequest("DELETE", "/api/v1/messages", nil)
+		r.Header.Set("Authorization", "Bearer reader")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, 403)
+
+		r.Header.Set("Authorization", "Bearer admin")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, 200)
+
+		r.Header.Set("Authorization", "Bearer nobody")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, 401)
+	})
+}
+
+func TestParseTokens(t *testing.T) {
+	Convey("ParseTokens should parse tokens and scopes", t, func() {
+		tokens, err := ParseTokens("abc:read|delete, def")
+		So(err, ShouldBeNil)
+		So(tokens, ShouldHaveLength, 2)
+		So(tokens[0].Token, ShouldEqual, "abc")
+		So(tokens[0].Scopes, ShouldResemble, Scopes{Read, Delete})
+		So(tokens[1].Scopes, ShouldResemble, AllScopes)
+
+		_, err = ParseTokens("abc:root")
+		So(err, ShouldNotBeNil)
+		_, err = ParseTokens(":read")
+		So(err, ShouldNotBeNil)
+		_, err = ParseTokens("abc:")
+		So(err, ShouldNotBeNil)
+		_, err = ParseTokens("abc: | ")
+		So(err, ShouldNotBeNil)
+		So((&Token{Token: "abc", Scopes: Scopes{}}).validate(), ShouldNotBeNil)
+	})
+
+	Convey("NewToken should generate a random token", t, func() {
+		t1, err := NewToken("ci", Scopes{Read})
+		So(err, ShouldBeNil)
+		t2, _ := NewToken("ci", Scopes{Read})
+		So(t1.Token, ShouldHaveLength, 40)
+		So(t1.Token, ShouldNotEqual, t2.Token)
+	})
+}
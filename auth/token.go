@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Scope is a permission granted to an API token
+type Scope string
+
+// Scopes granted to API tokens
+const (
+	// Read allows messages, transcripts and events to be read
+	Read Scope = "read"
+	// Delete allows messages to be deleted
+	Delete Scope = "delete"
+	// Release allows messages to be released to outgoing SMTP servers
+	Release Scope = "release"
+	// Admin allows Jim, webhooks and outgoing SMTP servers to be managed
+	Admin Scope = "admin"
+	// Inject allows messages to be added through the API
+	Inject Scope = "inject"
+)
+
+// AllScopes are granted to basic auth users and tokens without scopes
+var AllScopes = Scopes{Read, Delete, Release, Admin, Inject}
+
+// Scopes is a list of scopes
+type Scopes []Scope
+
+// Has returns true if scope is in the list
+func (s Scopes) Has(scope Scope) bool {
+	for _, g := range s {
+		if g == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseScopes parses a list of scope names separated by commas or |
+func ParseScopes(s string) (Scopes, error) {
+	var scopes Scopes
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '|' }) {
+		scope := Scope(strings.TrimSpace(name))
+		if len(scope) == 0 {
+			continue
+		}
+		if !AllScopes.Has(scope) {
+			return nil, fmt.Errorf("invalid scope: %s", scope)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// Token is an API token
+type Token struct {
+	Name   string `json:"name,omitempty"`
+	Token  string `json:"token"`
+	Scopes Scopes `json:"scopes"`
+}
+
+func (t *Token) validate() error {
+	if len(t.Token) == 0 {
+		return fmt.Errorf("token %q is empty", t.Name)
+	}
+	if t.Scopes == nil {
+		t.Scopes = AllScopes
+	} else if len(t.Scopes) == 0 {
+		return fmt.Errorf("token %q has no scopes", t.Name)
+	}
+	for _, s := range t.Scopes {
+		if !AllScopes.Has(s) {
+			return fmt.Errorf("token %q has invalid scope: %s", t.Name, s)
+		}
+	}
+	return nil
+}
+
+// ParseTokens parses a comma separated list of tokens, each optionally
+// followed by a colon and its scopes separated by |, e.g.
+// "abc:read|delete,def". Tokens without a colon are granted every scope.
+func ParseTokens(s string) ([]*Token, error) {
+	var tokens []*Token
+	for n, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		t := &Token{Token: item}
+		if i := strings.Index(item, ":"); i >= 0 {
+			scopes, err := ParseScopes(item[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			if len(scopes) == 0 {
+				return nil, fmt.Errorf("token %d has an empty scope list", n+1)
+			}
+			t.Token, t.Scopes = item[:i], scopes
+		}
+		if err := t.validate(); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+// Load reads a JSON array of tokens from file
+func Load(file string) ([]*Token, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []*Token
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		if err := t.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+// NewToken returns a token with a random value
+func NewToken(name string, scopes Scopes) (*Token, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	t := &Token{Name: name, Token: hex.EncodeToString(b), Scopes: scopes}
+	return t, t.validate()
+}
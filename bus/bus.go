@@ -0,0 +1,130 @@
+package bus
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mailhog/MailHog-Server/metrics"
+	"github.com/mailhog/data"
+)
+
+// Bus delivers received messages to subscribers without blocking the
+// publisher
+//
+// Each subscriber has a bounded buffer. If a subscriber falls behind and
+// its buffer is full, messages published to it are dropped and counted.
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers []*Subscriber
+}
+
+// Subscriber receives messages published to a Bus
+type Subscriber struct {
+	Name string
+	// C receives published messages
+	C <-chan *data.Message
+
+	c         chan *data.Message
+	delivered uint64
+	dropped   uint64
+	// checked is the number of messages dropped when Check last ran
+	checked uint64
+}
+
+// Stats describes the state of a subscriber
+type Stats struct {
+	Name      string `json:"name"`
+	Buffered  int    `json:"buffered"`
+	Capacity  int    `json:"capacity"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// New returns a Bus without subscribers
+func New() *Bus {
+	return &Bus{}
+}
+
+// Subscribe adds a subscriber with a buffer of size messages
+func (b *Bus) Subscribe(name string, size int) *Subscriber {
+	c := make(chan *data.Message, size)
+	s := &Subscriber{Name: name, C: c, c: c}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, s)
+	return s
+}
+
+// Unsubscribe removes a subscriber and closes its channel
+func (b *Bus) Unsubscribe(s *Subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, sub := range b.subscribers {
+		if sub == s {
+			b.subscribers = append(b.subscribers[:i], b.subscribers[i+1:]...)
+			close(s.c)
+			return
+		}
+	}
+}
+
+// Publish sends msg to every subscriber with room in its buffer
+func (b *Bus) Publish(msg *data.Message) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subscribers {
+		select {
+		case s.c <- msg:
+			atomic.AddUint64(&s.delivered, 1)
+			metrics.BusDelivered.WithLabelValues(s.Name).Inc()
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			metrics.BusDropped.WithLabelValues(s.Name).Inc()
+		}
+	}
+}
+
+// Stats returns the state of every subscriber
+func (b *Bus) Stats() []Stats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	stats := make([]Stats, 0, len(b.subscribers))
+	for _, s := range b.subscribers {
+		stats = append(stats, Stats{
+			Name:      s.Name,
+			Buffered:  len(s.c),
+			Capacity:  cap(s.c),
+			Delivered: atomic.LoadUint64(&s.delivered),
+			Dropped:   atomic.LoadUint64(&s.dropped),
+		})
+	}
+	return stats
+}
+
+// Check implements health.Check, failing if any subscriber has dropped
+// messages since the previous check, which means it isn't keeping up. A
+// buffer which is only momentarily full doesn't fail the check.
+func (b *Bus) Check() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var dropping []string
+	for _, s := range b.subscribers {
+		dropped := atomic.LoadUint64(&s.dropped)
+		if atomic.SwapUint64(&s.checked, dropped) < dropped {
+			dropping = append(dropping, s.Name)
+		}
+	}
+	if len(dropping) > 0 {
+		return fmt.Errorf("subscriber dropping messages: %s", strings.Join(dropping, ", "))
+	}
+	return nil
+}
+
+// Dropped returns the number of messages dropped because the
+// subscriber's buffer was full
+func (s *Subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
@@ -0,0 +1,44 @@
+package bus
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mailhog/data"
+)
+
+func TestPublish(t *testing.T) {
+	Convey("Publish should deliver to every subscriber without blocking", t, func() {
+		b := New()
+		fast := b.Subscribe("fast", 2)
+		slow := b.Subscribe("slow", 1)
+
+		b.Publish(&data.Message{ID: "1"})
+		So((<-fast.C).ID, ShouldEqual, "1")
+		So(b.Check(), ShouldBeNil)
+
+		b.Publish(&data.Message{ID: "2"})
+		So((<-fast.C).ID, ShouldEqual, "2")
+		So(slow.Dropped(), ShouldEqual, 1)
+		So(b.Check(), ShouldNotBeNil)
+		So((<-slow.C).ID, ShouldEqual, "1")
+		So(b.Check(), ShouldBeNil)
+
+		stats := b.Stats()
+		So(stats, ShouldHaveLength, 2)
+		So(stats[0].Delivered, ShouldEqual, 2)
+		So(stats[1].Delivered, ShouldEqual, 1)
+		So(stats[1].Dropped, ShouldEqual, 1)
+	})
+
+	Convey("Unsubscribe should close the subscriber's channel", t, func() {
+		b := New()
+		s := b.Subscribe("test", 1)
+		b.Unsubscribe(s)
+		_, ok := <-s.C
+		So(ok, ShouldBeFalse)
+		So(b.Stats(), ShouldHaveLength, 0)
+		b.Publish(&data.Message{ID: "1"})
+	})
+}
@@ -1,13 +1,28 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/ian-kent/envconf"
+	"github.com/mailhog/MailHog-Server/auth"
+	"github.com/mailhog/MailHog-Server/bus"
+	"github.com/mailhog/MailHog-Server/cors"
+	"github.com/mailhog/MailHog-Server/logging"
 	"github.com/mailhog/MailHog-Server/monkey"
+	"github.com/mailhog/MailHog-Server/netutil"
+	"github.com/mailhog/MailHog-Server/tlsutil"
+	"github.com/mailhog/MailHog-Server/transcript"
+	"github.com/mailhog/MailHog-Server/webhooks"
 	"github.com/mailhog/data"
 	"github.com/mailhog/storage"
 )
@@ -15,40 +30,100 @@ import (
 // DefaultConfig is the default config
 func DefaultConfig() *Config {
 	return &Config{
-		SMTPBindAddr: "0.0.0.0:1025",
-		APIBindAddr:  "0.0.0.0:8025",
-		Hostname:     "mailhog.example",
-		MongoURI:     "127.0.0.1:27017",
-		MongoDb:      "mailhog",
-		MongoColl:    "messages",
-		MaildirPath:  "",
-		StorageType:  "memory",
-		CORSOrigin:   "",
-		WebPath:      "",
-		MessageChan:  make(chan *data.Message),
-		OutgoingSMTP: make(map[string]*OutgoingSMTP),
+		SMTPBindAddr:    "0.0.0.0:1025",
+		SocketMode:      0660,
+		APIBindAddr:     "0.0.0.0:8025",
+		Hostname:        "mailhog.example",
+		MongoURI:        "127.0.0.1:27017",
+		MongoDb:         "mailhog",
+		MongoColl:       "messages",
+		MaildirPath:     "",
+		StorageType:     "memory",
+		CORSOrigin:      "",
+		CORSHeaders:     "Content-Type, Authorization",
+		CORS:            &cors.Policy{},
+		WebPath:         "",
+		LogLevel:        "info",
+		LogFormat:       "text",
+		TranscriptLimit: 1000,
+		SessionLogLimit: 100,
+		Bus:             bus.New(),
+		BusBuffer:       100,
+		EventHistory:    1000,
+		Monkey:          monkey.NewConfig(Jim, false),
+		Rules:           monkey.NewRuleSet(),
+		MonkeyLogLimit:  100,
+		MonkeyStats:     monkey.NewStats(100),
+		Scenario:        monkey.NewScenarioRunner(),
+		OutgoingSMTP:    make(map[string]*OutgoingSMTP),
 	}
 }
 
 // Config is the config, kind of
 type Config struct {
-	SMTPBindAddr     string
-	APIBindAddr      string
-	Hostname         string
-	MongoURI         string
-	MongoDb          string
-	MongoColl        string
-	StorageType      string
-	CORSOrigin       string
-	MaildirPath      string
-	InviteJim        bool
-	Storage          storage.Storage
-	MessageChan      chan *data.Message
-	Assets           func(asset string) ([]byte, error)
-	Monkey           monkey.ChaosMonkey
-	OutgoingSMTPFile string
-	OutgoingSMTP     map[string]*OutgoingSMTP
-	WebPath          string
+	SMTPBindAddr      string
+	SMTPProxyString   string
+	SMTPProxyTrusted  netutil.Trusted
+	SMTPTLSCert       string
+	SMTPTLSKey        string
+	SMTPTLSSelfSigned bool
+	SMTPTLS           *tls.Config
+	APIBindAddr       string
+	APITLSCert        string
+	APITLSKey         string
+	APITLSSelfSigned  bool
+	APITLSClientCA    string
+	APIRedirectAddr   string
+	APITLS            *tls.Config
+	SocketModeString  string
+	SocketMode        os.FileMode
+	Hostname          string
+	MongoURI          string
+	MongoDb           string
+	MongoColl         string
+	StorageType       string
+	CORSOrigin        string
+	CORSCredentials   bool
+	CORSHeaders       string
+	CORSExpose        string
+	CORSMaxAge        int
+	CORS              *cors.Policy
+	APITokens         string
+	APITokensFile     string
+	MaildirPath       string
+	InviteJim         bool
+	JimProfile        string
+	JimConfigFile     string
+	Storage           storage.Storage
+	Bus               *bus.Bus
+	BusBuffer         int
+	EventHistory      int
+	Assets            func(asset string) ([]byte, error)
+	Monkey            *monkey.Config
+	RulesFile         string
+	Rules             *monkey.RuleSet
+	MonkeyLogLimit    int
+	MonkeyStats       *monkey.Stats
+	ScenarioFile      string
+	Scenario          *monkey.ScenarioRunner
+	OutgoingSMTPFile  string
+	OutgoingSMTP      map[string]*OutgoingSMTP
+	WebPath           string
+	LogLevel          string
+	LogFormat         string
+	SMTPTranscript    bool
+	SMTPRedact        bool
+	TranscriptLimit   int
+	SessionLogLimit   int
+	Transcripts       *transcript.Store
+	WebhooksFile      string
+	Webhooks          *webhooks.Dispatcher
+
+	// MessageChan receives messages published to Bus, with a buffer of
+	// BusBuffer messages. Messages are dropped while it's full.
+	//
+	// Deprecated: use Bus.Subscribe, which reports dropped messages.
+	MessageChan chan *data.Message
 }
 
 // OutgoingSMTP is an outgoing SMTP server config
@@ -65,68 +140,222 @@ type OutgoingSMTP struct {
 
 var cfg = DefaultConfig()
 
-// Jim is a monkey
+// Jim is a monkey, configured by flags. Changes made at runtime are made
+// to Config.Monkey, not to Jim.
 var Jim = &monkey.Jim{}
 
 // Configure configures stuff
 func Configure() *Config {
+	if err := logging.Configure(cfg.LogLevel, cfg.LogFormat); err != nil {
+		fatal(err)
+	}
+	logging.Transcript = cfg.SMTPTranscript
+	logging.Redact = cfg.SMTPRedact
+
+	tokens, err := auth.ParseTokens(cfg.APITokens)
+	if err != nil {
+		fatal(err)
+	}
+	auth.Tokens = append(auth.Tokens, tokens...)
+	if len(cfg.APITokensFile) > 0 {
+		tokens, err := auth.Load(cfg.APITokensFile)
+		if err != nil {
+			fatal(err)
+		}
+		auth.Tokens = append(auth.Tokens, tokens...)
+	}
+
+	mode, err := strconv.ParseUint(cfg.SocketModeString, 8, 32)
+	if err != nil {
+		fatal(fmt.Errorf("invalid socket mode: %s", cfg.SocketModeString))
+	}
+	cfg.SocketMode = os.FileMode(mode)
+
+	cfg.SMTPProxyTrusted, err = netutil.ParseTrusted(cfg.SMTPProxyString)
+	if err != nil {
+		fatal(err)
+	}
+
+	if len(cfg.SMTPTLSCert) > 0 || len(cfg.SMTPTLSKey) > 0 || cfg.SMTPTLSSelfSigned {
+		cfg.SMTPTLS, err = tlsutil.ServerConfig(cfg.SMTPTLSCert, cfg.SMTPTLSKey, cfg.SMTPTLSSelfSigned, []string{cfg.Hostname, "localhost", "127.0.0.1", "::1"}, "")
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	if len(cfg.APITLSCert) > 0 || len(cfg.APITLSKey) > 0 || cfg.APITLSSelfSigned {
+		hosts := []string{cfg.Hostname, "localhost", "127.0.0.1", "::1"}
+		if host, _, err := net.SplitHostPort(cfg.APIBindAddr); err == nil && len(host) > 0 && !net.ParseIP(host).IsUnspecified() {
+			hosts = append(hosts, host)
+		}
+		cfg.APITLS, err = tlsutil.ServerConfig(cfg.APITLSCert, cfg.APITLSKey, cfg.APITLSSelfSigned, hosts, cfg.APITLSClientCA)
+		if err != nil {
+			fatal(err)
+		}
+	} else if len(cfg.APITLSClientCA) > 0 || len(cfg.APIRedirectAddr) > 0 {
+		fatal(errors.New("-api-tls-client-ca and -api-http-redirect-addr require -api-tls-cert and -api-tls-key, or -api-tls-self-signed"))
+	}
+
+	// a subscriber without a buffer would drop every message
+	if cfg.BusBuffer < 1 {
+		fatal(fmt.Errorf("invalid bus buffer %d, must be at least 1", cfg.BusBuffer))
+	}
+
+	cfg.MessageChan = make(chan *data.Message, cfg.BusBuffer)
+	go forward(cfg.Bus.Subscribe("MessageChan", cfg.BusBuffer), cfg.MessageChan)
+
+	cfg.CORS = cors.NewPolicy(cfg.CORSOrigin, cfg.CORSCredentials, cfg.CORSHeaders, cfg.CORSExpose, cfg.CORSMaxAge)
+
 	switch cfg.StorageType {
 	case "memory":
-		log.Println("Using in-memory storage")
+		slog.Info("Using in-memory storage")
 		cfg.Storage = storage.CreateInMemory()
 	case "mongodb":
-		log.Println("Using MongoDB message storage")
+		slog.Info("Using MongoDB message storage")
 		s := storage.CreateMongoDB(cfg.MongoURI, cfg.MongoDb, cfg.MongoColl)
 		if s == nil {
-			log.Println("MongoDB storage unavailable, reverting to in-memory storage")
+			slog.Warn("MongoDB storage unavailable, reverting to in-memory storage")
 			cfg.Storage = storage.CreateInMemory()
 		} else {
-			log.Println("Connected to MongoDB")
+			slog.Info("Connected to MongoDB")
 			cfg.Storage = s
 		}
 	case "maildir":
-		log.Println("Using maildir message storage")
+		slog.Info("Using maildir message storage")
 		s := storage.CreateMaildir(cfg.MaildirPath)
 		cfg.Storage = s
 	default:
-		log.Fatalf("Invalid storage type %s", cfg.StorageType)
+		fatal(fmt.Errorf("Invalid storage type %s", cfg.StorageType))
 	}
 
+	cfg.Transcripts = transcript.NewStore(cfg.TranscriptLimit, cfg.SessionLogLimit)
+
+	if err := Jim.LoadSettings(flag.CommandLine, "jim-", cfg.JimProfile, cfg.JimConfigFile); err != nil {
+		fatal(err)
+	}
+	if len(cfg.JimProfile) > 0 {
+		cfg.InviteJim = true
+	}
 	Jim.Configure(func(message string, args ...interface{}) {
-		log.Printf(message, args...)
+		slog.Debug(strings.TrimSpace(fmt.Sprintf(message, args...)), "monkey", "jim")
 	})
-	if cfg.InviteJim {
-		cfg.Monkey = Jim
+	if err := Jim.Validate(); err != nil {
+		fatal(err)
+	}
+	cfg.Monkey = monkey.NewConfig(Jim, cfg.InviteJim)
+
+	cfg.MonkeyStats = monkey.NewStats(cfg.MonkeyLogLimit)
+
+	if len(cfg.RulesFile) > 0 {
+		rules, err := monkey.LoadRules(cfg.RulesFile)
+		if err != nil {
+			fatal(err)
+		}
+		if err := cfg.Rules.Set(rules); err != nil {
+			fatal(err)
+		}
+	}
+
+	if len(cfg.ScenarioFile) > 0 {
+		scenario, err := monkey.LoadScenario(cfg.ScenarioFile)
+		if err != nil {
+			fatal(err)
+		}
+		if err := cfg.Scenario.Load(scenario, cfg.Monkey.Load().Jim); err != nil {
+			fatal(err)
+		}
+		if err := cfg.Scenario.Start(); err != nil {
+			fatal(err)
+		}
 	}
 
 	if len(cfg.OutgoingSMTPFile) > 0 {
 		b, err := ioutil.ReadFile(cfg.OutgoingSMTPFile)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		var o map[string]*OutgoingSMTP
 		err = json.Unmarshal(b, &o)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		cfg.OutgoingSMTP = o
 	}
 
+	cfg.Webhooks = webhooks.NewDispatcher()
+	if len(cfg.WebhooksFile) > 0 {
+		hooks, err := webhooks.Load(cfg.WebhooksFile)
+		if err != nil {
+			fatal(err)
+		}
+		for _, h := range hooks {
+			if err := cfg.Webhooks.Add(h); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
 	return cfg
 }
 
+// forward sends messages from sub to c, dropping them if c is full, so a
+// channel nobody reads doesn't stall the subscriber
+func forward(sub *bus.Subscriber, c chan *data.Message) {
+	for msg := range sub.C {
+		select {
+		case c <- msg:
+		default:
+		}
+	}
+}
+
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
+}
+
 // RegisterFlags registers flags
 func RegisterFlags() {
-	flag.StringVar(&cfg.SMTPBindAddr, "smtp-bind-addr", envconf.FromEnvP("MH_SMTP_BIND_ADDR", "0.0.0.0:1025").(string), "SMTP bind interface and port, e.g. 0.0.0.0:1025 or just :1025")
-	flag.StringVar(&cfg.APIBindAddr, "api-bind-addr", envconf.FromEnvP("MH_API_BIND_ADDR", "0.0.0.0:8025").(string), "HTTP bind interface and port for API, e.g. 0.0.0.0:8025 or just :8025")
+	flag.StringVar(&cfg.SMTPBindAddr, "smtp-bind-addr", envconf.FromEnvP("MH_SMTP_BIND_ADDR", "0.0.0.0:1025").(string), "SMTP bind interface and port, e.g. 0.0.0.0:1025 or just :1025, or unix:/path for a unix domain socket")
+	flag.StringVar(&cfg.SMTPProxyString, "smtp-proxy-trusted", envconf.FromEnvP("MH_SMTP_PROXY_TRUSTED", "").(string), "Comma separated addresses or CIDR networks of load balancers sending a PROXY protocol header on SMTP connections")
+	flag.StringVar(&cfg.APIBindAddr, "api-bind-addr", envconf.FromEnvP("MH_API_BIND_ADDR", "0.0.0.0:8025").(string), "HTTP bind interface and port for API, e.g. 0.0.0.0:8025 or just :8025, or unix:/path for a unix domain socket")
+	flag.StringVar(&cfg.SMTPTLSCert, "smtp-tls-cert", envconf.FromEnvP("MH_SMTP_TLS_CERT", "").(string), "TLS certificate file offered to SMTP clients with STARTTLS")
+	flag.StringVar(&cfg.SMTPTLSKey, "smtp-tls-key", envconf.FromEnvP("MH_SMTP_TLS_KEY", "").(string), "TLS key file offered to SMTP clients with STARTTLS")
+	flag.BoolVar(&cfg.SMTPTLSSelfSigned, "smtp-tls-self-signed", envconf.FromEnvP("MH_SMTP_TLS_SELF_SIGNED", false).(bool), "Offer STARTTLS to SMTP clients using a generated self-signed certificate")
+	flag.StringVar(&cfg.APITLSCert, "api-tls-cert", envconf.FromEnvP("MH_API_TLS_CERT", "").(string), "TLS certificate file for the HTTP API")
+	flag.StringVar(&cfg.APITLSKey, "api-tls-key", envconf.FromEnvP("MH_API_TLS_KEY", "").(string), "TLS key file for the HTTP API")
+	flag.BoolVar(&cfg.APITLSSelfSigned, "api-tls-self-signed", envconf.FromEnvP("MH_API_TLS_SELF_SIGNED", false).(bool), "Serve the HTTP API with TLS using a generated self-signed certificate")
+	flag.StringVar(&cfg.APITLSClientCA, "api-tls-client-ca", envconf.FromEnvP("MH_API_TLS_CLIENT_CA", "").(string), "CA file used to verify client certificates, which are then required for HTTP API access")
+	flag.StringVar(&cfg.APIRedirectAddr, "api-http-redirect-addr", envconf.FromEnvP("MH_API_HTTP_REDIRECT_ADDR", "").(string), "HTTP bind interface and port redirecting to the HTTPS API, e.g. 0.0.0.0:8080")
+	flag.StringVar(&cfg.SocketModeString, "socket-mode", envconf.FromEnvP("MH_SOCKET_MODE", "0660").(string), "Permissions of unix domain sockets created for unix:/path bind addresses")
 	flag.StringVar(&cfg.Hostname, "hostname", envconf.FromEnvP("MH_HOSTNAME", "mailhog.example").(string), "Hostname for EHLO/HELO response, e.g. mailhog.example")
 	flag.StringVar(&cfg.StorageType, "storage", envconf.FromEnvP("MH_STORAGE", "memory").(string), "Message storage: 'memory' (default), 'mongodb' or 'maildir'")
 	flag.StringVar(&cfg.MongoURI, "mongo-uri", envconf.FromEnvP("MH_MONGO_URI", "127.0.0.1:27017").(string), "MongoDB URI, e.g. 127.0.0.1:27017")
 	flag.StringVar(&cfg.MongoDb, "mongo-db", envconf.FromEnvP("MH_MONGO_DB", "mailhog").(string), "MongoDB database, e.g. mailhog")
 	flag.StringVar(&cfg.MongoColl, "mongo-coll", envconf.FromEnvP("MH_MONGO_COLLECTION", "messages").(string), "MongoDB collection, e.g. messages")
-	flag.StringVar(&cfg.CORSOrigin, "cors-origin", envconf.FromEnvP("MH_CORS_ORIGIN", "").(string), "CORS Access-Control-Allow-Origin header for API endpoints")
+	flag.StringVar(&cfg.CORSOrigin, "cors-origin", envconf.FromEnvP("MH_CORS_ORIGIN", "").(string), "Comma separated origins allowed to make cross-origin API requests, e.g. https://*.example.com or * for any")
+	flag.BoolVar(&cfg.CORSCredentials, "cors-allow-credentials", envconf.FromEnvP("MH_CORS_ALLOW_CREDENTIALS", false).(bool), "Allow credentials in cross-origin API requests")
+	flag.StringVar(&cfg.CORSHeaders, "cors-allowed-headers", envconf.FromEnvP("MH_CORS_ALLOWED_HEADERS", "Content-Type, Authorization").(string), "Comma separated request headers allowed in cross-origin API requests, or * for any")
+	flag.StringVar(&cfg.CORSExpose, "cors-exposed-headers", envconf.FromEnvP("MH_CORS_EXPOSED_HEADERS", "").(string), "Comma separated response headers exposed to cross-origin API requests")
+	flag.IntVar(&cfg.CORSMaxAge, "cors-max-age", envconf.FromEnvP("MH_CORS_MAX_AGE", 0).(int), "Seconds browsers may cache CORS preflight responses for")
+	flag.StringVar(&cfg.APITokens, "api-tokens", envconf.FromEnvP("MH_API_TOKENS", "").(string), "Comma separated API tokens accepted as an alternative to basic auth, each optionally followed by :scope|scope")
+	flag.StringVar(&cfg.APITokensFile, "api-tokens-file", envconf.FromEnvP("MH_API_TOKENS_FILE", "").(string), "JSON file containing API tokens and their scopes")
 	flag.StringVar(&cfg.MaildirPath, "maildir-path", envconf.FromEnvP("MH_MAILDIR_PATH", "").(string), "Maildir path (if storage type is 'maildir')")
 	flag.BoolVar(&cfg.InviteJim, "invite-jim", envconf.FromEnvP("MH_INVITE_JIM", false).(bool), "Decide whether to invite Jim (beware, he causes trouble)")
+	flag.StringVar(&cfg.JimProfile, "jim-profile", envconf.FromEnvP("MH_JIM_PROFILE", "").(string), "Invite Jim with a named chaos profile: "+strings.Join(monkey.ProfileNames(), ", ")+". Other Jim settings override the profile's.")
+	flag.StringVar(&cfg.JimConfigFile, "jim-config", envconf.FromEnvP("MH_JIM_CONFIG", "").(string), "JSON file containing Jim's settings, in the format used by the API. Environment variables and flags override it.")
+	flag.StringVar(&cfg.RulesFile, "chaos-rules", envconf.FromEnvP("MH_CHAOS_RULES", "").(string), "JSON file containing chaos rules applied to SMTP sessions")
+	flag.StringVar(&cfg.ScenarioFile, "jim-scenario", envconf.FromEnvP("MH_JIM_SCENARIO", "").(string), "JSON file containing a chaos scenario, whose phases are activated on schedule from startup")
+	flag.IntVar(&cfg.MonkeyLogLimit, "jim-decision-log", envconf.FromEnvP("MH_JIM_DECISION_LOG", 100).(int), "Number of recent chaos monkey decisions kept for the stats API")
 	flag.StringVar(&cfg.OutgoingSMTPFile, "outgoing-smtp", envconf.FromEnvP("MH_OUTGOING_SMTP", "").(string), "JSON file containing outgoing SMTP servers")
+	flag.IntVar(&cfg.BusBuffer, "bus-buffer", envconf.FromEnvP("MH_BUS_BUFFER", 100).(int), "Number of received messages buffered for each API consumer before messages are dropped, at least 1")
+	flag.IntVar(&cfg.EventHistory, "event-history", envconf.FromEnvP("MH_EVENT_HISTORY", 1000).(int), "Number of events kept for clients resuming the event stream or websocket")
+	flag.StringVar(&cfg.WebhooksFile, "webhooks", envconf.FromEnvP("MH_WEBHOOKS", "").(string), "JSON file containing webhooks to notify of received messages")
+	flag.StringVar(&cfg.LogLevel, "log-level", envconf.FromEnvP("MH_LOG_LEVEL", "info").(string), "Log level: 'debug', 'info' (default), 'warn' or 'error'")
+	flag.StringVar(&cfg.LogFormat, "log-format", envconf.FromEnvP("MH_LOG_FORMAT", "text").(string), "Log format: 'text' (default) or 'json'")
+	flag.BoolVar(&cfg.SMTPTranscript, "smtp-transcript", envconf.FromEnvP("MH_SMTP_TRANSCRIPT", false).(bool), "Log every SMTP command and reply")
+	flag.BoolVar(&cfg.SMTPRedact, "smtp-transcript-redact", envconf.FromEnvP("MH_SMTP_TRANSCRIPT_REDACT", true).(bool), "Redact AUTH credentials and DATA contents from SMTP logs")
+	flag.IntVar(&cfg.TranscriptLimit, "transcript-limit", envconf.FromEnvP("MH_TRANSCRIPT_LIMIT", 1000).(int), "Number of message SMTP transcripts to keep")
+	flag.IntVar(&cfg.SessionLogLimit, "session-log-limit", envconf.FromEnvP("MH_SESSION_LOG_LIMIT", 100).(int), "Number of SMTP transcripts to keep for sessions which didn't deliver a message")
 	Jim.RegisterFlags()
 }
@@ -0,0 +1,167 @@
+package cors
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Methods are the methods allowed in cross-origin requests to the API
+const Methods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// Origins is a list of origins allowed to make cross-origin requests to
+// the API. "*" allows any origin, and origins may contain * wildcards,
+// e.g. "https://*.example.com" or "http://localhost:*".
+type Origins []string
+
+// ParseOrigins parses a comma separated list of origins
+func ParseOrigins(s string) Origins {
+	var origins Origins
+	for _, o := range split(s) {
+		origins = append(origins, strings.TrimSuffix(o, "/"))
+	}
+	return origins
+}
+
+// Allowed returns true if origin matches an origin in the list
+func (o Origins) Allowed(origin string) bool {
+	return len(o.match(origin)) > 0
+}
+
+// match returns the origin in the list which origin matches
+func (o Origins) match(origin string) string {
+	if len(origin) == 0 {
+		return ""
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range o {
+		if allowed == "*" {
+			return allowed
+		}
+		if ok, _ := path.Match(strings.ToLower(allowed), origin); ok {
+			return allowed
+		}
+	}
+	return ""
+}
+
+// SameOrigin returns true if r has no Origin header, as sent by
+// non-browser clients, or if its origin matches the host it was sent to
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// Policy controls which cross-origin requests browsers allow
+type Policy struct {
+	Origins Origins
+	// AllowCredentials lets browsers send cookies and basic auth
+	// credentials with cross-origin requests
+	AllowCredentials bool
+	// AllowedHeaders are the request headers allowed in cross-origin
+	// requests. "*" allows any header.
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers scripts are allowed to read
+	ExposedHeaders []string
+	// MaxAge is the number of seconds browsers may cache a preflight
+	// response for. It isn't sent if zero.
+	MaxAge int
+}
+
+// NewPolicy returns a Policy from comma separated lists of origins,
+// allowed headers and exposed headers
+func NewPolicy(origins string, allowCredentials bool, allowedHeaders, exposedHeaders string, maxAge int) *Policy {
+	return &Policy{
+		Origins:          ParseOrigins(origins),
+		AllowCredentials: allowCredentials,
+		AllowedHeaders:   split(allowedHeaders),
+		ExposedHeaders:   split(exposedHeaders),
+		MaxAge:           maxAge,
+	}
+}
+
+// applied is the context key marking requests the policy has been
+// applied to
+type applied struct{}
+
+// Handler adds CORS headers to responses from h and answers OPTIONS
+// requests, including preflight requests, without calling h
+//
+// The policy is only applied once to each request, so a router using
+// Handler as middleware can also be wrapped by it.
+func (p *Policy) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(applied{}) != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), applied{}, true))
+
+		if len(p.Origins) > 0 {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		origin := r.Header.Get("Origin")
+		matched := p.Origins.match(origin)
+		if len(matched) > 0 {
+			if matched == "*" && !p.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if p.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if r.Method != "OPTIONS" {
+			if len(matched) > 0 && len(p.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if len(matched) > 0 && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", Methods)
+			if headers := p.allowedHeaders(r); len(headers) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			if p.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(p.MaxAge))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (p *Policy) allowedHeaders(r *http.Request) string {
+	for _, h := range p.AllowedHeaders {
+		if h == "*" {
+			return r.Header.Get("Access-Control-Request-Headers")
+		}
+	}
+	return strings.Join(p.AllowedHeaders, ", ")
+}
+
+func split(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
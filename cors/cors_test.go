@@ -0,0 +1,78 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOrigins(t *testing.T) {
+	Convey("Origins should match exact origins and wildcards", t, func() {
+		o := ParseOrigins("https://mail.example.com/, https://*.test.example, http://localhost:*")
+		So(o, ShouldHaveLength, 3)
+		So(o.Allowed("https://mail.example.com"), ShouldBeTrue)
+		So(o.Allowed("HTTPS://MAIL.EXAMPLE.COM"), ShouldBeTrue)
+		So(o.Allowed("http://mail.example.com"), ShouldBeFalse)
+		So(o.Allowed("https://a.test.example"), ShouldBeTrue)
+		So(o.Allowed("https://test.example"), ShouldBeFalse)
+		So(o.Allowed("http://localhost:3000"), ShouldBeTrue)
+		So(o.Allowed(""), ShouldBeFalse)
+		So(Origins{"*"}.Allowed("https://anywhere.example"), ShouldBeTrue)
+	})
+}
+
+func TestHandler(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+
+	Convey("Handler should add headers for allowed origins", t, func() {
+		p := NewPolicy("https://*.example.com", true, "Content-Type", "X-Total", 600)
+
+		r := httptest.NewRequest("GET", "/api/v2/messages", nil)
+		r.Header.Set("Origin", "https://ui.example.com")
+		w := httptest.NewRecorder()
+		p.Handler(h).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, 200)
+		So(w.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "https://ui.example.com")
+		So(w.Header().Get("Access-Control-Allow-Credentials"), ShouldEqual, "true")
+		So(w.Header().Get("Access-Control-Expose-Headers"), ShouldEqual, "X-Total")
+		So(w.Header()["Vary"], ShouldContain, "Origin")
+
+		r.Header.Set("Origin", "https://evil.example")
+		w = httptest.NewRecorder()
+		p.Handler(h).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, 200)
+		So(w.Header().Get("Access-Control-Allow-Origin"), ShouldBeEmpty)
+	})
+
+	Convey("Handler should answer preflight requests", t, func() {
+		p := NewPolicy("*", false, "*", "", 600)
+
+		r := httptest.NewRequest("OPTIONS", "/api/v2/jim", nil)
+		r.Header.Set("Origin", "https://ui.example.com")
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+		r.Header.Set("Access-Control-Request-Headers", "X-Custom")
+		w := httptest.NewRecorder()
+		p.Handler(h).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, 204)
+		So(w.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "*")
+		So(w.Header().Get("Access-Control-Allow-Methods"), ShouldEqual, Methods)
+		So(w.Header().Get("Access-Control-Allow-Headers"), ShouldEqual, "X-Custom")
+		So(w.Header().Get("Access-Control-Max-Age"), ShouldEqual, "600")
+		So(w.Header().Get("Access-Control-Allow-Credentials"), ShouldBeEmpty)
+	})
+
+	Convey("Handler should only apply the policy once", t, func() {
+		p := NewPolicy("*", false, "", "", 0)
+
+		r := httptest.NewRequest("GET", "/api/v2/messages", nil)
+		r.Header.Set("Origin", "https://ui.example.com")
+		w := httptest.NewRecorder()
+		p.Handler(p.Handler(h)).ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, 200)
+		So(w.Header()["Vary"], ShouldResemble, []string{"Origin"})
+	})
+}
@@ -0,0 +1,101 @@
+package health
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mailhog/storage"
+)
+
+// Check reports whether a component is ready. A nil error means ready.
+type Check func() error
+
+var (
+	mu     sync.RWMutex
+	checks = make(map[string]Check)
+)
+
+// Register adds a named readiness check, replacing any existing check
+// with the same name
+func Register(name string, check Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks[name] = check
+}
+
+// Result is the outcome of a single readiness check
+type Result struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Run runs every registered check. ok is true if all checks passed.
+func Run() (results map[string]Result, ok bool) {
+	mu.RLock()
+	registered := make(map[string]Check, len(checks))
+	for name, check := range checks {
+		registered[name] = check
+	}
+	mu.RUnlock()
+
+	ok = true
+	results = make(map[string]Result)
+	for name, check := range registered {
+		if err := check(); err != nil {
+			ok = false
+			results[name] = Result{Status: "fail", Error: err.Error()}
+			continue
+		}
+		results[name] = Result{Status: "ok"}
+	}
+	return
+}
+
+// Flag is a Check which fails until it has been set
+type Flag struct {
+	set    int32
+	reason error
+}
+
+// NewFlag returns an unset Flag which fails with reason
+func NewFlag(reason string) *Flag {
+	return &Flag{reason: errors.New(reason)}
+}
+
+// Set sets or clears the flag
+func (f *Flag) Set(ok bool) {
+	var v int32
+	if ok {
+		v = 1
+	}
+	atomic.StoreInt32(&f.set, v)
+}
+
+// Check implements Check
+func (f *Flag) Check() error {
+	if atomic.LoadInt32(&f.set) == 1 {
+		return nil
+	}
+	return f.reason
+}
+
+// PingStorage returns a Check which performs a lightweight request
+// against the storage backend
+func PingStorage(s storage.Storage) Check {
+	return func() error {
+		switch s := s.(type) {
+		case *storage.InMemory:
+			return nil
+		case *storage.MongoDB:
+			return s.Session.Ping()
+		case *storage.Maildir:
+			_, err := os.Stat(s.Path)
+			return err
+		default:
+			s.Count()
+			return nil
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package health
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mailhog/storage"
+)
+
+func TestRun(t *testing.T) {
+	Convey("Run should report a result for each registered check", t, func() {
+		flag := NewFlag("listener not bound")
+		Register("flag", flag.Check)
+		Register("broken", func() error { return errors.New("broken") })
+
+		results, ok := Run()
+		So(ok, ShouldBeFalse)
+		So(results["flag"], ShouldResemble, Result{Status: "fail", Error: "listener not bound"})
+		So(results["broken"], ShouldResemble, Result{Status: "fail", Error: "broken"})
+
+		flag.Set(true)
+		Register("broken", func() error { return nil })
+		results, ok = Run()
+		So(ok, ShouldBeTrue)
+		So(results["flag"], ShouldResemble, Result{Status: "ok"})
+		So(results["broken"], ShouldResemble, Result{Status: "ok"})
+	})
+}
+
+func TestPingStorage(t *testing.T) {
+	Convey("PingStorage should check the storage backend", t, func() {
+		So(PingStorage(storage.CreateInMemory())(), ShouldBeNil)
+		So(PingStorage(&storage.Maildir{Path: t.TempDir()})(), ShouldBeNil)
+		So(PingStorage(&storage.Maildir{Path: "/nonexistent/maildir"})(), ShouldNotBeNil)
+	})
+}
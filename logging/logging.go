@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+var (
+	// Transcript enables logging of every SMTP command and reply
+	Transcript bool
+	// Redact hides AUTH credentials and DATA contents in SMTP transcripts
+	Redact = true
+)
+
+// Configure installs the default logger for level ("debug", "info",
+// "warn" or "error") and format ("text" or "json")
+func Configure(level, format string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %s", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %s", format)
+	}
+
+	slog.SetDefault(slog.New(h))
+	return nil
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"log/slog"
 	"os"
 
-	gohttp "net/http"
-
-	"github.com/ian-kent/go-log/log"
 	"github.com/mailhog/MailHog-Server/api"
+	"github.com/mailhog/MailHog-Server/auth"
 	"github.com/mailhog/MailHog-Server/config"
 	"github.com/mailhog/MailHog-Server/smtp"
-	"github.com/mailhog/MailHog-UI/assets"
 	comcfg "github.com/mailhog/MailHog/config"
 	"github.com/mailhog/http"
 )
@@ -28,6 +28,11 @@ func configure() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		generateToken(os.Args[2:])
+		os.Exit(0)
+	}
+
 	configure()
 
 	if comconf.AuthFile != "" {
@@ -35,17 +40,34 @@ func main() {
 	}
 
 	exitCh = make(chan int)
-	cb := func(r gohttp.Handler) {
-		api.CreateAPI(conf, r)
-	}
-	go http.Listen(conf.APIBindAddr, assets.Asset, exitCh, cb)
+	go api.Listen(conf, exitCh)
 	go smtp.Listen(conf, exitCh)
 
 	for {
 		select {
 		case <-exitCh:
-			log.Printf("Received exit signal")
+			slog.Info("Received exit signal")
 			os.Exit(0)
 		}
 	}
 }
+
+// generateToken prints a new API token for the file passed to -api-tokens-file
+func generateToken(args []string) {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	name := fs.String("name", "", "Token name")
+	scopes := fs.String("scopes", "read", "Comma separated scopes: read, delete, release, admin, inject")
+	fs.Parse(args)
+
+	s, err := auth.ParseScopes(*scopes)
+	if err == nil {
+		var t *auth.Token
+		if t, err = auth.NewToken(*name, s); err == nil {
+			b, _ := json.MarshalIndent(t, "", "  ")
+			fmt.Println(string(b))
+			return
+		}
+	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
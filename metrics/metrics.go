@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/mailhog/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "mailhog"
+
+var (
+	// SessionsAccepted counts SMTP connections accepted by the listener
+	SessionsAccepted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "smtp",
+		Name:      "sessions_accepted_total",
+		Help:      "Number of SMTP sessions accepted.",
+	})
+	// SessionsRejected counts SMTP connections rejected or dropped, by reason
+	SessionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "smtp",
+		Name:      "sessions_rejected_total",
+		Help:      "Number of SMTP sessions rejected or dropped.",
+	}, []string{"reason"})
+	// CommandsRejected counts SMTP commands rejected by the chaos monkey
+	CommandsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "smtp",
+		Name:      "commands_rejected_total",
+		Help:      "Number of SMTP commands rejected by the chaos monkey.",
+	}, []string{"command"})
+	// SessionsActive is the number of SMTP sessions in progress
+	SessionsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "smtp",
+		Name:      "sessions_active",
+		Help:      "Number of SMTP sessions in progress.",
+	})
+	// BytesReceived counts bytes read from SMTP clients
+	BytesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "smtp",
+		Name:      "received_bytes_total",
+		Help:      "Number of bytes received from SMTP clients.",
+	})
+	// MessagesStored counts messages successfully written to storage
+	MessagesStored = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_stored_total",
+		Help:      "Number of messages stored.",
+	})
+	// Releases counts message releases, by result ("sent" or "failed")
+	Releases = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "releases_total",
+		Help:      "Number of messages released to outgoing SMTP servers.",
+	}, []string{"result"})
+	// BusDelivered counts messages delivered to bus subscribers
+	BusDelivered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "bus",
+		Name:      "delivered_total",
+		Help:      "Number of messages delivered to message bus subscribers.",
+	}, []string{"subscriber"})
+	// BusDropped counts messages dropped because a bus subscriber's buffer was full
+	BusDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "bus",
+		Name:      "dropped_total",
+		Help:      "Number of messages dropped because a message bus subscriber's buffer was full.",
+	}, []string{"subscriber"})
+	// WebSocketClients is the number of connected websocket clients
+	WebSocketClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "websocket_clients",
+		Help:      "Number of connected websocket clients.",
+	})
+	// EventStreamListeners is the number of connected event stream listeners
+	EventStreamListeners = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "eventstream_listeners",
+		Help:      "Number of connected event stream listeners.",
+	})
+	// StorageLatency observes storage operation latency, by operation
+	StorageLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "operation_duration_seconds",
+		Help:      "Storage operation latency in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		SessionsAccepted,
+		SessionsRejected,
+		CommandsRejected,
+		SessionsActive,
+		BytesReceived,
+		MessagesStored,
+		Releases,
+		BusDelivered,
+		BusDropped,
+		WebSocketClients,
+		EventStreamListeners,
+		StorageLatency,
+	)
+}
+
+// watched is the storage reported by the storage message gauge
+var watched struct {
+	sync.Mutex
+	once    sync.Once
+	storage storage.Storage
+}
+
+// WatchStorage reports the message count of s with a gauge
+//
+// The count is read from storage when metrics are scraped. The gauge is
+// registered the first time WatchStorage is called, and later calls
+// replace the storage it reports.
+func WatchStorage(s storage.Storage) {
+	watched.Lock()
+	watched.storage = s
+	watched.Unlock()
+
+	watched.once.Do(func() {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "messages",
+			Help:      "Number of messages in storage.",
+		}, storageCount))
+	})
+}
+
+func storageCount() float64 {
+	watched.Lock()
+	s := watched.storage
+	watched.Unlock()
+	if s == nil {
+		return 0
+	}
+	return float64(s.Count())
+}
+
+// TimeStorage starts timing a storage operation.
+//
+// Call ObserveDuration on the result once the operation completes.
+func TimeStorage(operation string) *prometheus.Timer {
+	return prometheus.NewTimer(StorageLatency.WithLabelValues(operation))
+}
+
+// Handler returns the /metrics handler
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
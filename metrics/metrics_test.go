@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mailhog/data"
+	"github.com/mailhog/storage"
+)
+
+func scrape() string {
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestHandler(t *testing.T) {
+	Convey("Handler should expose the session and storage series", t, func() {
+		s := storage.CreateInMemory()
+		s.Store(&data.Message{ID: "1"})
+		WatchStorage(s)
+
+		SessionsAccepted.Inc()
+		SessionsRejected.WithLabelValues("monkey").Inc()
+		SessionsActive.Inc()
+		defer SessionsActive.Dec()
+		TimeStorage("store").ObserveDuration()
+
+		body := scrape()
+		So(body, ShouldContainSubstring, "mailhog_smtp_sessions_accepted_total ")
+		So(body, ShouldContainSubstring, `mailhog_smtp_sessions_rejected_total{reason="monkey"} `)
+		So(body, ShouldContainSubstring, "mailhog_smtp_sessions_active 1")
+		So(body, ShouldContainSubstring, "mailhog_storage_messages 1")
+		So(body, ShouldContainSubstring, `mailhog_storage_operation_duration_seconds_count{operation="store"} `)
+	})
+
+	Convey("WatchStorage should replace the storage it reports", t, func() {
+		first := storage.CreateInMemory()
+		first.Store(&data.Message{ID: "1"})
+		WatchStorage(first)
+
+		second := storage.CreateInMemory()
+		second.Store(&data.Message{ID: "1"})
+		second.Store(&data.Message{ID: "2"})
+		So(func() { WatchStorage(second) }, ShouldNotPanic)
+		So(scrape(), ShouldContainSubstring, "mailhog_storage_messages 2")
+	})
+}
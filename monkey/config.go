@@ -0,0 +1,255 @@
+package monkey
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ian-kent/linkio"
+	"github.com/mailhog/data"
+)
+
+// Version is a snapshot of a Config. Versions are never modified once
+// they're stored, so they can be read without locking.
+type Version struct {
+	Version uint64 `json:"version"`
+	// Enabled is true if Jim is invited. His settings are kept while he
+	// isn't, so he's invited back with them.
+	Enabled bool `json:"enabled"`
+	Jim     *Jim `json:"jim"`
+	// Live is true if the change which made this version applies to
+	// sessions in progress, not only to new sessions
+	Live    bool      `json:"live"`
+	Applied time.Time `json:"applied"`
+}
+
+// Monkey returns Jim if he's enabled, or nil
+func (v *Version) Monkey() ChaosMonkey {
+	if !v.Enabled || v.Jim == nil {
+		return nil
+	}
+	return v.Jim
+}
+
+// Config is the chaos monkey configuration, which can be changed at
+// runtime while sessions read it
+type Config struct {
+	// mu serialises changes, reads use current and live
+	mu      sync.Mutex
+	current atomic.Value
+	// live is the last version applied to live sessions, if any
+	live atomic.Value
+}
+
+// NewConfig returns a Config at version 1 with Jim's settings
+func NewConfig(jim *Jim, enabled bool) *Config {
+	c := &Config{}
+	c.current.Store(&Version{Version: 1, Enabled: enabled, Jim: jim, Applied: time.Now()})
+	return c
+}
+
+// Load returns the current version
+func (c *Config) Load() *Version {
+	return c.current.Load().(*Version)
+}
+
+// Update calls f with a copy of the current version and, unless f returns
+// an error, stores it as the next version
+func (c *Config) Update(f func(v *Version) error) (*Version, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cur := c.Load()
+	next := *cur
+	next.Live = false
+	if err := f(&next); err != nil {
+		return nil, err
+	}
+	next.Version = cur.Version + 1
+	next.Applied = time.Now()
+	c.current.Store(&next)
+	if next.Live {
+		c.live.Store(&next)
+	}
+	return &next, nil
+}
+
+// lastLive returns the last version applied to live sessions, or nil
+func (c *Config) lastLive() *Version {
+	v, _ := c.live.Load().(*Version)
+	return v
+}
+
+// Session returns the monkey for a new session. It's the session monkey
+// of the one build returns for the current version. build is called again
+// when a later version is applied to live sessions, and the monkey it
+// returns replaces the session's, keeping its place in the order sessions
+// were accepted.
+//
+// Throughput restrictions are only decided when a session is accepted, so
+// live changes don't affect them.
+func (c *Config) Session(build func(v *Version) ChaosMonkey) ChaosMonkey {
+	v := c.Load()
+	m := build(v)
+	n := sessionIndex(m)
+	return &liveMonkey{config: c, version: v.Version, build: build, session: n, m: sessionAt(m, n)}
+}
+
+// resumer is implemented by monkeys with session state, so a monkey
+// replacing one mid-session can carry on where it left off
+type resumer interface {
+	resume(remoteIP net.IP, sender string)
+}
+
+// liveMonkey is a session's monkey, replaced when a change is applied
+// to live sessions. It's only used by its session's goroutine.
+type liveMonkey struct {
+	config *Config
+	// version is the version the session's monkey was built from, and
+	// session its index, which replacements keep
+	version uint64
+	session uint64
+	build   func(v *Version) ChaosMonkey
+	m       ChaosMonkey
+
+	remoteIP net.IP
+	sender   string
+}
+
+// current returns the session's monkey, after replacing it if a newer
+// version has been applied to live sessions. Versions for new sessions
+// only, including any made since, are ignored.
+func (l *liveMonkey) current() ChaosMonkey {
+	if v := l.config.lastLive(); v != nil && v.Version > l.version {
+		l.version = v.Version
+		l.m = sessionAt(l.build(v), l.session)
+		if r, ok := l.m.(resumer); ok {
+			r.resume(l.remoteIP, l.sender)
+		}
+	}
+	return l.m
+}
+
+func (l *liveMonkey) RegisterFlags() {}
+
+func (l *liveMonkey) Configure(logf func(string, ...interface{})) {}
+
+func (l *liveMonkey) ForSession() ChaosMonkey {
+	return l
+}
+
+func (l *liveMonkey) Accept(conn net.Conn) bool {
+	if conn != nil {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			l.remoteIP = addr.IP
+		}
+	}
+	m := l.current()
+	return m == nil || m.Accept(conn)
+}
+
+func (l *liveMonkey) LinkSpeed() *linkio.Throughput {
+	if m := l.current(); m != nil {
+		return m.LinkSpeed()
+	}
+	return nil
+}
+
+func (l *liveMonkey) ValidRCPT(rcpt string) bool {
+	return l.RCPTReply(rcpt) == nil
+}
+
+func (l *liveMonkey) ValidMAIL(mail string) bool {
+	return l.MAILReply(mail) == nil
+}
+
+func (l *liveMonkey) ValidAUTH(mechanism string, args ...string) bool {
+	return l.AUTHReply(mechanism, args...) == nil
+}
+
+func (l *liveMonkey) Disconnect() bool {
+	m := l.current()
+	return m != nil && m.Disconnect()
+}
+
+func (l *liveMonkey) Command(verb, args string) *Reply {
+	if strings.ToUpper(verb) == "MAIL" {
+		l.sender = envelopeAddress(args)
+	}
+	if m, ok := l.current().(CommandMonkey); ok {
+		return m.Command(verb, args)
+	}
+	return nil
+}
+
+func (l *liveMonkey) MAILReply(mail string) *Reply {
+	if m := l.current(); m != nil {
+		return MAILReply(m, mail)
+	}
+	return nil
+}
+
+func (l *liveMonkey) RCPTReply(rcpt string) *Reply {
+	if m := l.current(); m != nil {
+		return RCPTReply(m, rcpt)
+	}
+	return nil
+}
+
+func (l *liveMonkey) AUTHReply(mechanism string, args ...string) *Reply {
+	if m := l.current(); m != nil {
+		return AUTHReply(m, mechanism, args...)
+	}
+	return nil
+}
+
+func (l *liveMonkey) DATAReply(from string, to []string) *Reply {
+	if m, ok := l.current().(DataMonkey); ok {
+		return m.DATAReply(from, to)
+	}
+	return nil
+}
+
+func (l *liveMonkey) ReceivedMessage(msg *data.SMTPMessage) *Outcome {
+	if m, ok := l.current().(DataMonkey); ok {
+		return m.ReceivedMessage(msg)
+	}
+	return nil
+}
+
+func (l *liveMonkey) ReplyDelay(verb string) time.Duration {
+	if m, ok := l.current().(DelayMonkey); ok {
+		return m.ReplyDelay(verb)
+	}
+	return 0
+}
+
+func (l *liveMonkey) EHLOFault() string {
+	if m, ok := l.current().(ProtocolMonkey); ok {
+		return m.EHLOFault()
+	}
+	return ""
+}
+
+func (l *liveMonkey) STARTTLSReply() *Reply {
+	if m, ok := l.current().(ProtocolMonkey); ok {
+		return m.STARTTLSReply()
+	}
+	return nil
+}
+
+func (l *liveMonkey) CertificateFault() string {
+	if m, ok := l.current().(ProtocolMonkey); ok {
+		return m.CertificateFault()
+	}
+	return ""
+}
+
+func (l *liveMonkey) TruncateReply(verb string, lines int) int {
+	if m, ok := l.current().(ProtocolMonkey); ok {
+		return m.TruncateReply(verb, lines)
+	}
+	return lines
+}
@@ -0,0 +1,121 @@
+package monkey
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfig(t *testing.T) {
+	Convey("Config updates should create new versions", t, func() {
+		j := newJim(1)
+		c := NewConfig(j, false)
+		v := c.Load()
+		So(v.Version, ShouldEqual, 1)
+		So(v.Monkey(), ShouldBeNil)
+
+		v, err := c.Update(func(v *Version) error {
+			v.Enabled = true
+			return nil
+		})
+		So(err, ShouldBeNil)
+		So(v.Version, ShouldEqual, 2)
+		So(c.Load(), ShouldEqual, v)
+		So(c.Load().Monkey(), ShouldEqual, j)
+
+		_, err = c.Update(func(v *Version) error {
+			v.Enabled = false
+			return errors.New("no")
+		})
+		So(err, ShouldNotBeNil)
+		So(c.Load().Version, ShouldEqual, 2)
+		So(c.Load().Enabled, ShouldBeTrue)
+	})
+
+	Convey("Sessions should only pick up live changes", t, func() {
+		accept, reject := newJim(1), newJim(1)
+		accept.AcceptChance, accept.RejectSenderChance = 1, 0
+		reject.AcceptChance, reject.RejectSenderChance = 1, 1
+
+		c := NewConfig(accept, true)
+		build := func(v *Version) ChaosMonkey { return v.Monkey() }
+		m := c.Session(build)
+		So(m.Accept(nil), ShouldBeTrue)
+		So(m.ValidMAIL("a@test"), ShouldBeTrue)
+
+		c.Update(func(v *Version) error {
+			v.Jim = reject
+			return nil
+		})
+		So(m.ValidMAIL("a@test"), ShouldBeTrue)
+		So(c.Session(build).ValidMAIL("a@test"), ShouldBeFalse)
+
+		c.Update(func(v *Version) error {
+			v.Live = true
+			return nil
+		})
+		So(m.ValidMAIL("a@test"), ShouldBeFalse)
+
+		c.Update(func(v *Version) error {
+			v.Enabled, v.Live = false, true
+			return nil
+		})
+		So(m.ValidMAIL("a@test"), ShouldBeTrue)
+		So(m.Disconnect(), ShouldBeFalse)
+	})
+
+	Convey("Rules should keep their session state when replaced live", t, func() {
+		set := NewRuleSet()
+		So(set.Set([]*Rule{{Stage: StageRCPT, RemoteIP: "10.0.0.1", Action: ActionReject}}), ShouldBeNil)
+		c := NewConfig(newJim(1), false)
+		build := func(v *Version) ChaosMonkey { return &Rules{Set: set} }
+		m := c.Session(build)
+		So(m.Accept(&addrConn{nil, &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}}), ShouldBeTrue)
+
+		c.Update(func(v *Version) error {
+			v.Live = true
+			return nil
+		})
+		So(m.(CommandMonkey).Command("RCPT", "TO:<b@test>"), ShouldNotBeNil)
+	})
+	Convey("Sessions should pick up live changes made before later changes", t, func() {
+		accept, reject := newJim(1), newJim(1)
+		accept.AcceptChance, accept.RejectSenderChance = 1, 0
+		reject.AcceptChance, reject.RejectSenderChance = 1, 1
+
+		c := NewConfig(accept, true)
+		m := c.Session(func(v *Version) ChaosMonkey { return v.Monkey() })
+
+		c.Update(func(v *Version) error {
+			v.Jim, v.Live = reject, true
+			return nil
+		})
+		c.Update(func(v *Version) error {
+			v.Enabled = false
+			return nil
+		})
+		So(m.ValidMAIL("a@test"), ShouldBeFalse)
+	})
+
+	Convey("Live changes shouldn't count another session", t, func() {
+		j := newJim(1)
+		j.AcceptChance = 1
+		c := NewConfig(j, true)
+		build := func(v *Version) ChaosMonkey { return v.Monkey() }
+		m := c.Session(build)
+		So(m.Accept(nil), ShouldBeTrue)
+
+		c.Update(func(v *Version) error {
+			v.Live = true
+			return nil
+		})
+		// the replacement makes the same decisions as the first session
+		l := m.(*liveMonkey)
+		So(l.current().(*Jim).rand.Float64(), ShouldEqual, newLockedRand(sessionSeed(j.Seed, 1)).Float64())
+		So(j.state.sessions, ShouldEqual, 1)
+
+		So(c.Session(build).(*liveMonkey).session, ShouldEqual, 2)
+	})
+}
@@ -0,0 +1,131 @@
+package monkey
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Delay distributions
+const (
+	// DelayFixed always delays by Min
+	DelayFixed = "fixed"
+	// DelayUniform delays by a uniformly distributed time between Min and Max
+	DelayUniform = "uniform"
+	// DelayNormal delays by a normally distributed time centred between Min
+	// and Max, with three standard deviations either side, clamped to Min
+	// and Max
+	DelayNormal = "normal"
+)
+
+// Delay is a distribution of reply delays
+type Delay struct {
+	Distribution string        `json:"distribution"`
+	Min          time.Duration `json:"min"`
+	Max          time.Duration `json:"max,omitempty"`
+}
+
+// ParseDelay parses a delay written as distribution:min[:max], e.g.
+// "fixed:30s" or "uniform:1s:30s"
+func ParseDelay(s string) (*Delay, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid delay: %s", s)
+	}
+	d := &Delay{Distribution: parts[0]}
+	var err error
+	if d.Min, err = time.ParseDuration(parts[1]); err != nil {
+		return nil, fmt.Errorf("invalid delay: %s", s)
+	}
+	if len(parts) == 3 {
+		if d.Max, err = time.ParseDuration(parts[2]); err != nil {
+			return nil, fmt.Errorf("invalid delay: %s", s)
+		}
+	}
+	return d, d.validate()
+}
+
+func (d *Delay) validate() error {
+	switch d.Distribution {
+	case DelayFixed:
+	case DelayUniform, DelayNormal:
+		if d.Max < d.Min {
+			return fmt.Errorf("%s delay max %s is less than min %s", d.Distribution, d.Max, d.Min)
+		}
+	default:
+		return fmt.Errorf("invalid delay distribution: %s", d.Distribution)
+	}
+	if d.Min < 0 {
+		return fmt.Errorf("delay min %s is negative", d.Min)
+	}
+	return nil
+}
+
+// String returns the delay in the format read by ParseDelay
+func (d *Delay) String() string {
+	if d.Distribution == DelayFixed {
+		return d.Distribution + ":" + d.Min.String()
+	}
+	return d.Distribution + ":" + d.Min.String() + ":" + d.Max.String()
+}
+
+type delayRand interface {
+	Float64() float64
+	NormFloat64() float64
+}
+
+// sample returns a delay drawn from the distribution
+func (d *Delay) sample(r delayRand) time.Duration {
+	if d.Distribution == DelayFixed || d.Max <= d.Min {
+		return d.Min
+	}
+	span := float64(d.Max - d.Min)
+	switch d.Distribution {
+	case DelayUniform:
+		return d.Min + time.Duration(r.Float64()*span)
+	case DelayNormal:
+		v := float64(d.Min) + span/2 + r.NormFloat64()*span/6
+		return time.Duration(math.Max(float64(d.Min), math.Min(float64(d.Max), v)))
+	}
+	return d.Min
+}
+
+// Delays are reply delays by SMTP verb, which can be set from a comma
+// separated flag, e.g. "RCPT=uniform:1s:30s,EOD=fixed:30s"
+type Delays map[string]*Delay
+
+var _ flag.Value = &Delays{}
+
+// String implements flag.Value.String
+func (d *Delays) String() string {
+	var s []string
+	for verb, delay := range *d {
+		s = append(s, verb+"="+delay.String())
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+// Set implements flag.Value.Set
+func (d *Delays) Set(s string) error {
+	delays := make(Delays)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid reply delay: %s", item)
+		}
+		delay, err := ParseDelay(kv[1])
+		if err != nil {
+			return err
+		}
+		delays[strings.ToUpper(strings.TrimSpace(kv[0]))] = delay
+	}
+	*d = delays
+	return nil
+}
@@ -0,0 +1,60 @@
+package monkey
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseDelay(t *testing.T) {
+	Convey("Delays should be parsed", t, func() {
+		d, err := ParseDelay("fixed:30s")
+		So(err, ShouldBeNil)
+		So(d, ShouldResemble, &Delay{Distribution: DelayFixed, Min: 30 * time.Second})
+
+		d, err = ParseDelay("uniform:1s:30s")
+		So(err, ShouldBeNil)
+		So(d, ShouldResemble, &Delay{Distribution: DelayUniform, Min: time.Second, Max: 30 * time.Second})
+		So(d.String(), ShouldEqual, "uniform:1s:30s")
+
+		_, err = ParseDelay("uniform:30s:1s")
+		So(err, ShouldNotBeNil)
+		_, err = ParseDelay("poisson:1s:2s")
+		So(err, ShouldNotBeNil)
+		_, err = ParseDelay("fixed")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Delays should be parsed by command", t, func() {
+		var d Delays
+		So(d.Set("rcpt=uniform:1s:30s, EOD=fixed:5s"), ShouldBeNil)
+		So(d, ShouldHaveLength, 2)
+		So(d["RCPT"].Max, ShouldEqual, 30*time.Second)
+		So(d.String(), ShouldEqual, "EOD=fixed:5s,RCPT=uniform:1s:30s")
+		So(d.Set("RCPT"), ShouldNotBeNil)
+	})
+}
+
+func TestDelaySample(t *testing.T) {
+	Convey("Samples should be between min and max", t, func() {
+		r := rand.New(rand.NewSource(1))
+		for _, dist := range []string{DelayUniform, DelayNormal} {
+			d := &Delay{Distribution: dist, Min: time.Second, Max: 2 * time.Second}
+			for i := 0; i < 100; i++ {
+				So(d.sample(r), ShouldBeBetweenOrEqual, time.Second, 2*time.Second)
+			}
+		}
+		So((&Delay{Distribution: DelayFixed, Min: time.Second, Max: 2 * time.Second}).sample(r), ShouldEqual, time.Second)
+	})
+
+	Convey("Jim should delay replies by command", t, func() {
+		j := newJim(1)
+		So(j.ReplyDelay("RCPT"), ShouldEqual, 0)
+
+		j.ReplyDelays = Delays{"RCPT": {Distribution: DelayFixed, Min: time.Second}, "*": {Distribution: DelayFixed, Min: time.Millisecond}}
+		So(j.ReplyDelay("RCPT"), ShouldEqual, time.Second)
+		So(j.ReplyDelay("MAIL"), ShouldEqual, time.Millisecond)
+	})
+}
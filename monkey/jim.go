@@ -1,12 +1,18 @@
 package monkey
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"math/rand"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ian-kent/linkio"
+	"github.com/mailhog/data"
 )
 
 // Jim is a chaos monkey
@@ -19,10 +25,100 @@ type Jim struct {
 	RejectSenderChance    float64
 	RejectRecipientChance float64
 	RejectAuthChance      float64
-	logf                  func(message string, args ...interface{})
+	// RejectSenderCodes, RejectRecipientCodes and RejectAuthCodes are the
+	// reply codes Jim picks from at random when he rejects a command
+	RejectSenderCodes    Codes
+	RejectRecipientCodes Codes
+	RejectAuthCodes      Codes
+	// RejectDataChance is the chance of rejecting the DATA command, and
+	// RejectMessageChance of rejecting a message after its final dot
+	RejectDataChance    float64
+	RejectDataCodes     Codes
+	RejectMessageChance float64
+	RejectMessageCodes  Codes
+	// DiscardMessageChance is the chance of acknowledging a message
+	// without storing it, and DuplicateMessageChance of storing it twice
+	DiscardMessageChance   float64
+	DuplicateMessageChance float64
+	// DelayMessageChance is the chance of waiting between DelayMessageMin
+	// and DelayMessageMax before acknowledging a message
+	DelayMessageChance float64
+	DelayMessageMin    time.Duration
+	DelayMessageMax    time.Duration
+	// ReplyDelays delay replies to the commands they're keyed by, with
+	// "*" matching commands without their own delay
+	ReplyDelays Delays
+	// DropExtensionsChance and GarbleExtensionsChance are the chances of
+	// breaking the extensions listed in reply to EHLO
+	DropExtensionsChance   float64
+	GarbleExtensionsChance float64
+	// RejectSTARTTLSChance is the chance of refusing STARTTLS with 454,
+	// and ExpiredCertificateChance and MismatchedCertificateChance of
+	// serving a broken certificate when it's accepted
+	RejectSTARTTLSChance        float64
+	ExpiredCertificateChance    float64
+	MismatchedCertificateChance float64
+	// TruncateReplyChance is the chance of cutting a multiline reply
+	// short, and ShutdownChance of replying to a command with 421 and
+	// closing the connection
+	TruncateReplyChance float64
+	ShutdownChance      float64
+	// Seed seeds Jim's decisions. Jim makes the same decisions for each
+	// connection, in the order they're accepted, when given the same seed.
+	// A random seed is chosen if it's zero.
+	Seed int64
+
+	logf  func(message string, args ...interface{})
+	rand  *lockedRand
+	state *jimState
+}
+
+// jimState is shared by a Jim and its sessions
+type jimState struct {
+	sessions uint64
+}
+
+// lockedRand is a random source safe for concurrent use
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (r *lockedRand) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Float64()
+}
+
+func (r *lockedRand) NormFloat64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.NormFloat64()
+}
+
+func (r *lockedRand) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Intn(n)
+}
+
+// sessionSeed derives the seed for the nth session from seed, using the
+// SplitMix64 finaliser so sessions of nearby seeds aren't correlated
+func sessionSeed(seed int64, n uint64) int64 {
+	z := uint64(seed) + n*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return int64(z ^ (z >> 31))
 }
 
 // RegisterFlags implements ChaosMonkey.RegisterFlags
+//
+// Each flag can also be set by an environment variable, e.g. MH_JIM_ACCEPT
+// for -jim-accept, once LoadSettings is called.
 func (j *Jim) RegisterFlags() {
 	flag.Float64Var(&j.DisconnectChance, "jim-disconnect", 0.005, "Chance of disconnect")
 	flag.Float64Var(&j.AcceptChance, "jim-accept", 0.99, "Chance of accept")
@@ -32,12 +128,42 @@ func (j *Jim) RegisterFlags() {
 	flag.Float64Var(&j.RejectSenderChance, "jim-reject-sender", 0.05, "Chance of rejecting a sender (MAIL FROM)")
 	flag.Float64Var(&j.RejectRecipientChance, "jim-reject-recipient", 0.05, "Chance of rejecting a recipient (RCPT TO)")
 	flag.Float64Var(&j.RejectAuthChance, "jim-reject-auth", 0.05, "Chance of rejecting authentication (AUTH)")
+	j.RejectSenderCodes = Codes{550}
+	j.RejectRecipientCodes = Codes{550}
+	j.RejectAuthCodes = Codes{535}
+	flag.Var(&j.RejectSenderCodes, "jim-reject-sender-codes", "Comma separated reply codes used when rejecting a sender, e.g. 421,451,550")
+	flag.Var(&j.RejectRecipientCodes, "jim-reject-recipient-codes", "Comma separated reply codes used when rejecting a recipient, e.g. 450,452,550")
+	flag.Var(&j.RejectAuthCodes, "jim-reject-auth-codes", "Comma separated reply codes used when rejecting authentication, e.g. 454,535")
+	j.RejectDataCodes = Codes{554}
+	j.RejectMessageCodes = Codes{451}
+	flag.Float64Var(&j.RejectDataChance, "jim-reject-data", 0, "Chance of rejecting the DATA command")
+	flag.Var(&j.RejectDataCodes, "jim-reject-data-codes", "Comma separated reply codes used when rejecting the DATA command, e.g. 451,554")
+	flag.Float64Var(&j.RejectMessageChance, "jim-reject-message", 0, "Chance of rejecting a message after its final dot")
+	flag.Var(&j.RejectMessageCodes, "jim-reject-message-codes", "Comma separated reply codes used when rejecting a message, e.g. 451,452,552,554")
+	flag.Float64Var(&j.DiscardMessageChance, "jim-discard-message", 0, "Chance of acknowledging a message without storing it")
+	flag.Float64Var(&j.DuplicateMessageChance, "jim-duplicate-message", 0, "Chance of storing a message twice")
+	flag.Float64Var(&j.DelayMessageChance, "jim-delay-message", 0, "Chance of delaying the acknowledgement of a message")
+	flag.DurationVar(&j.DelayMessageMin, "jim-delay-message-min", time.Second, "Minimum delay before acknowledging a message")
+	flag.DurationVar(&j.DelayMessageMax, "jim-delay-message-max", 30*time.Second, "Maximum delay before acknowledging a message")
+	flag.Var(&j.ReplyDelays, "jim-reply-delay", "Comma separated reply delays by command, e.g. RCPT=uniform:1s:30s,EOD=normal:5s:60s, with distribution fixed:time, uniform:min:max or normal:min:max. CONNECT delays the greeting, EOD the reply after the final dot and * any other command.")
+	flag.Float64Var(&j.DropExtensionsChance, "jim-drop-extensions", 0, "Chance of replying to EHLO without any extensions")
+	flag.Float64Var(&j.GarbleExtensionsChance, "jim-garble-extensions", 0, "Chance of garbling the extensions listed in reply to EHLO")
+	flag.Float64Var(&j.RejectSTARTTLSChance, "jim-reject-starttls", 0, "Chance of refusing STARTTLS with 454")
+	flag.Float64Var(&j.ExpiredCertificateChance, "jim-expired-certificate", 0, "Chance of serving an expired certificate after STARTTLS")
+	flag.Float64Var(&j.MismatchedCertificateChance, "jim-mismatched-certificate", 0, "Chance of serving a certificate for another host after STARTTLS")
+	flag.Float64Var(&j.TruncateReplyChance, "jim-truncate-reply", 0, "Chance of cutting a multiline reply short")
+	flag.Float64Var(&j.ShutdownChance, "jim-shutdown", 0, "Chance of replying to a command with 421 and closing the connection")
+	flag.Int64Var(&j.Seed, "jim-seed", 0, "Seed for Jim's decisions, to reproduce an earlier run (random if 0)")
 }
 
 // Configure implements ChaosMonkey.Configure
 func (j *Jim) Configure(logf func(string, ...interface{})) {
 	j.logf = logf
-	rand.Seed(time.Now().Unix())
+	if j.Seed == 0 {
+		j.Seed = time.Now().UnixNano()
+	}
+	j.rand = newLockedRand(j.Seed)
+	j.state = &jimState{}
 }
 
 // ConfigureFrom lets us configure a new Jim from an old one without
@@ -46,9 +172,85 @@ func (j *Jim) ConfigureFrom(j2 *Jim) {
 	j.Configure(j2.logf)
 }
 
+// Validate returns an error if any of Jim's chances isn't between 0 and
+// 1, a minimum is greater than its maximum, or a reply code or delay is
+// invalid
+func (j *Jim) Validate() error {
+	chances := []struct {
+		name   string
+		chance float64
+	}{
+		{"DisconnectChance", j.DisconnectChance},
+		{"AcceptChance", j.AcceptChance},
+		{"LinkSpeedAffect", j.LinkSpeedAffect},
+		{"RejectSenderChance", j.RejectSenderChance},
+		{"RejectRecipientChance", j.RejectRecipientChance},
+		{"RejectAuthChance", j.RejectAuthChance},
+		{"RejectDataChance", j.RejectDataChance},
+		{"RejectMessageChance", j.RejectMessageChance},
+		{"DiscardMessageChance", j.DiscardMessageChance},
+		{"DuplicateMessageChance", j.DuplicateMessageChance},
+		{"DelayMessageChance", j.DelayMessageChance},
+		{"DropExtensionsChance", j.DropExtensionsChance},
+		{"GarbleExtensionsChance", j.GarbleExtensionsChance},
+		{"RejectSTARTTLSChance", j.RejectSTARTTLSChance},
+		{"ExpiredCertificateChance", j.ExpiredCertificateChance},
+		{"MismatchedCertificateChance", j.MismatchedCertificateChance},
+		{"TruncateReplyChance", j.TruncateReplyChance},
+		{"ShutdownChance", j.ShutdownChance},
+	}
+	for _, c := range chances {
+		if c.chance < 0 || c.chance > 1 {
+			return fmt.Errorf("%s must be between 0 and 1", c.name)
+		}
+	}
+
+	if j.LinkSpeedMin < 0 || j.LinkSpeedMax < j.LinkSpeedMin {
+		return errors.New("LinkSpeedMin must be between 0 and LinkSpeedMax")
+	}
+	if j.DelayMessageMin < 0 || j.DelayMessageMax < j.DelayMessageMin {
+		return errors.New("DelayMessageMin must be between 0 and DelayMessageMax")
+	}
+
+	for _, codes := range []Codes{j.RejectSenderCodes, j.RejectRecipientCodes, j.RejectAuthCodes, j.RejectDataCodes, j.RejectMessageCodes} {
+		for _, code := range codes {
+			if code < 400 || code > 599 {
+				return fmt.Errorf("invalid reply code: %d", code)
+			}
+		}
+	}
+	for verb, d := range j.ReplyDelays {
+		if d == nil {
+			return fmt.Errorf("%s reply delay is empty", verb)
+		}
+		if err := d.validate(); err != nil {
+			return fmt.Errorf("%s reply delay: %s", verb, err)
+		}
+	}
+	return nil
+}
+
+// ForSession implements SessionMonkey.ForSession
+//
+// Each session's decisions are made with a random source seeded from
+// Jim's seed and the number of sessions before it.
+func (j *Jim) ForSession() ChaosMonkey {
+	return j.forSession(j.nextSession())
+}
+
+func (j *Jim) nextSession() uint64 {
+	return atomic.AddUint64(&j.state.sessions, 1)
+}
+
+func (j *Jim) forSession(n uint64) ChaosMonkey {
+	s := *j
+	s.rand = newLockedRand(sessionSeed(j.Seed, n))
+	return &s
+}
+
 // Accept implements ChaosMonkey.Accept
 func (j *Jim) Accept(conn net.Conn) bool {
-	if rand.Float64() > j.AcceptChance {
+	if j.rand.Float64() > j.AcceptChance {
 		j.logf("Jim: Rejecting connection\n")
 		return false
 	}
@@ -58,10 +260,9 @@ func (j *Jim) Accept(conn net.Conn) bool {
 
 // LinkSpeed implements ChaosMonkey.LinkSpeed
 func (j *Jim) LinkSpeed() *linkio.Throughput {
-	rand.Seed(time.Now().Unix())
-	if rand.Float64() < j.LinkSpeedAffect {
+	if j.rand.Float64() < j.LinkSpeedAffect {
 		lsDiff := j.LinkSpeedMax - j.LinkSpeedMin
-		lsAffect := j.LinkSpeedMin + (lsDiff * rand.Float64())
+		lsAffect := j.LinkSpeedMin + (lsDiff * j.rand.Float64())
 		f := linkio.Throughput(lsAffect) * linkio.BytePerSecond
 		j.logf("Jim: Restricting throughput to %s\n", f)
 		return &f
@@ -70,39 +271,178 @@ func (j *Jim) LinkSpeed() *linkio.Throughput {
 	return nil
 }
 
-// ValidRCPT implements ChaosMonkey.ValidRCPT
-func (j *Jim) ValidRCPT(rcpt string) bool {
-	if rand.Float64() < j.RejectRecipientChance {
-		j.logf("Jim: Rejecting recipient %s\n", rcpt)
-		return false
+// reply returns a standard reply for a code picked from codes, or def
+// if codes is empty
+func (j *Jim) reply(codes Codes, def int) *Reply {
+	code := def
+	if len(codes) > 0 {
+		code = codes[j.rand.Intn(len(codes))]
+	}
+	return StandardReply(code)
+}
+
+// RCPTReply implements ReplyMonkey.RCPTReply
+func (j *Jim) RCPTReply(rcpt string) *Reply {
+	if j.rand.Float64() < j.RejectRecipientChance {
+		r := j.reply(j.RejectRecipientCodes, 550)
+		j.logf("Jim: Rejecting recipient %s with %d\n", rcpt, r.Code)
+		return r
 	}
 	j.logf("Jim: Allowing recipient%s\n", rcpt)
-	return true
+	return nil
 }
 
-// ValidMAIL implements ChaosMonkey.ValidMAIL
-func (j *Jim) ValidMAIL(mail string) bool {
-	if rand.Float64() < j.RejectSenderChance {
-		j.logf("Jim: Rejecting sender %s\n", mail)
-		return false
+// MAILReply implements ReplyMonkey.MAILReply
+func (j *Jim) MAILReply(mail string) *Reply {
+	if j.rand.Float64() < j.RejectSenderChance {
+		r := j.reply(j.RejectSenderCodes, 550)
+		j.logf("Jim: Rejecting sender %s with %d\n", mail, r.Code)
+		return r
 	}
 	j.logf("Jim: Allowing sender %s\n", mail)
-	return true
+	return nil
+}
+
+// AUTHReply implements ReplyMonkey.AUTHReply
+func (j *Jim) AUTHReply(mechanism string, args ...string) *Reply {
+	if j.rand.Float64() < j.RejectAuthChance {
+		r := j.reply(j.RejectAuthCodes, 535)
+		j.logf("Jim: Rejecting authentication %s: %s with %d\n", mechanism, args, r.Code)
+		return r
+	}
+	j.logf("Jim: Allowing authentication %s: %s\n", mechanism, args)
+	return nil
+}
+
+// ValidRCPT implements ChaosMonkey.ValidRCPT
+func (j *Jim) ValidRCPT(rcpt string) bool {
+	return j.RCPTReply(rcpt) == nil
+}
+
+// ValidMAIL implements ChaosMonkey.ValidMAIL
+func (j *Jim) ValidMAIL(mail string) bool {
+	return j.MAILReply(mail) == nil
 }
 
 // ValidAUTH implements ChaosMonkey.ValidAUTH
 func (j *Jim) ValidAUTH(mechanism string, args ...string) bool {
-	if rand.Float64() < j.RejectAuthChance {
-		j.logf("Jim: Rejecting authentication %s: %s\n", mechanism, args)
-		return false
+	return j.AUTHReply(mechanism, args...) == nil
+}
+
+// DATAReply implements DataMonkey.DATAReply
+func (j *Jim) DATAReply(from string, to []string) *Reply {
+	if j.chance(j.RejectDataChance) {
+		r := j.reply(j.RejectDataCodes, 554)
+		j.logf("Jim: Rejecting DATA from %s with %d\n", from, r.Code)
+		return r
 	}
-	j.logf("Jim: Allowing authentication %s: %s\n", mechanism, args)
-	return true
+	return nil
+}
+
+// ReceivedMessage implements DataMonkey.ReceivedMessage
+func (j *Jim) ReceivedMessage(msg *data.SMTPMessage) *Outcome {
+	var o Outcome
+	if j.chance(j.DelayMessageChance) {
+		o.Delay = j.DelayMessageMin + time.Duration(j.rand.Float64()*float64(j.DelayMessageMax-j.DelayMessageMin))
+		j.logf("Jim: Delaying acknowledgement by %s\n", o.Delay)
+	}
+	switch {
+	case j.chance(j.RejectMessageChance):
+		o.Reply = j.reply(j.RejectMessageCodes, 451)
+		j.logf("Jim: Rejecting message from %s with %d\n", msg.From, o.Reply.Code)
+	case j.chance(j.DiscardMessageChance):
+		o.Discard = true
+		j.logf("Jim: Discarding message from %s\n", msg.From)
+	case j.chance(j.DuplicateMessageChance):
+		o.Copies = 1
+		j.logf("Jim: Duplicating message from %s\n", msg.From)
+	default:
+		if o.Delay == 0 {
+			return nil
+		}
+	}
+	return &o
+}
+
+// ReplyDelay implements DelayMonkey.ReplyDelay
+func (j *Jim) ReplyDelay(verb string) time.Duration {
+	d, ok := j.ReplyDelays[verb]
+	if !ok {
+		d, ok = j.ReplyDelays["*"]
+	}
+	if !ok {
+		return 0
+	}
+	delay := d.sample(j.rand)
+	j.logf("Jim: Delaying %s reply by %s\n", verb, delay)
+	return delay
+}
+
+// chance returns true with probability p. Unlike the chances Jim has
+// always had, it doesn't use up a random number if p is zero, so adding
+// message and protocol faults doesn't change the decisions made for a
+// seed.
+func (j *Jim) chance(p float64) bool {
+	return p > 0 && j.rand.Float64() < p
+}
+
+// Command implements CommandMonkey.Command
+func (j *Jim) Command(verb, args string) *Reply {
+	if strings.ToUpper(verb) != "QUIT" && j.chance(j.ShutdownChance) {
+		j.logf("Jim: Shutting down in reply to %s\n", verb)
+		return StandardReply(421)
+	}
+	return nil
+}
+
+// EHLOFault implements ProtocolMonkey.EHLOFault
+func (j *Jim) EHLOFault() string {
+	switch {
+	case j.chance(j.DropExtensionsChance):
+		j.logf("Jim: Dropping EHLO extensions\n")
+		return FaultDropExtensions
+	case j.chance(j.GarbleExtensionsChance):
+		j.logf("Jim: Garbling EHLO extensions\n")
+		return FaultGarbleExtensions
+	}
+	return ""
+}
+
+// STARTTLSReply implements ProtocolMonkey.STARTTLSReply
+func (j *Jim) STARTTLSReply() *Reply {
+	if j.chance(j.RejectSTARTTLSChance) {
+		j.logf("Jim: Refusing STARTTLS\n")
+		return STARTTLSReply()
+	}
+	return nil
+}
+
+// CertificateFault implements ProtocolMonkey.CertificateFault
+func (j *Jim) CertificateFault() string {
+	switch {
+	case j.chance(j.ExpiredCertificateChance):
+		j.logf("Jim: Serving an expired certificate\n")
+		return FaultExpiredCertificate
+	case j.chance(j.MismatchedCertificateChance):
+		j.logf("Jim: Serving a mismatched certificate\n")
+		return FaultMismatchedCertificate
+	}
+	return ""
+}
+
+// TruncateReply implements ProtocolMonkey.TruncateReply
+func (j *Jim) TruncateReply(verb string, lines int) int {
+	if lines > 1 && j.chance(j.TruncateReplyChance) {
+		n := 1 + j.rand.Intn(lines-1)
+		j.logf("Jim: Truncating %s reply to %d of %d lines\n", verb, n, lines)
+		return n
+	}
+	return lines
 }
 
 // Disconnect implements ChaosMonkey.Disconnect
 func (j *Jim) Disconnect() bool {
-	if rand.Float64() < j.DisconnectChance {
+	if j.rand.Float64() < j.DisconnectChance {
 		j.logf("Jim: Being nasty, kicking them off\n")
 		return true
 	}
@@ -0,0 +1,151 @@
+package monkey
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mailhog/data"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// decisions returns the decisions made by n sessions of j
+func decisions(j *Jim, n int) []bool {
+	var d []bool
+	for i := 0; i < n; i++ {
+		s := j.ForSession()
+		d = append(d, s.Accept(nil), s.ValidMAIL("from"), s.ValidRCPT("to"), s.Disconnect())
+	}
+	return d
+}
+
+func newJim(seed int64) *Jim {
+	j := &Jim{
+		Seed:                  seed,
+		AcceptChance:          0.5,
+		RejectSenderChance:    0.5,
+		RejectRecipientChance: 0.5,
+		DisconnectChance:      0.5,
+	}
+	j.Configure(func(string, ...interface{}) {})
+	return j
+}
+
+func TestJimSeed(t *testing.T) {
+	Convey("Jim should make the same decisions for the same seed", t, func() {
+		So(decisions(newJim(42), 20), ShouldResemble, decisions(newJim(42), 20))
+		So(decisions(newJim(42), 20), ShouldNotResemble, decisions(newJim(43), 20))
+	})
+
+	Convey("Each session's decisions should only depend on its order", t, func() {
+		j1, j2 := newJim(42), newJim(42)
+		a1, b1 := j1.ForSession(), j1.ForSession()
+		a2, b2 := j2.ForSession(), j2.ForSession()
+
+		// interleave the sessions differently
+		x := []bool{a1.ValidMAIL("a"), a1.ValidRCPT("a"), b1.ValidMAIL("b"), b1.ValidRCPT("b")}
+		y2 := []bool{b2.ValidMAIL("b"), b2.ValidRCPT("b")}
+		x2 := []bool{a2.ValidMAIL("a"), a2.ValidRCPT("a")}
+		So(x, ShouldResemble, append(x2, y2...))
+	})
+
+	Convey("Jim should choose a seed if none is set", t, func() {
+		So(newJim(0).Seed, ShouldNotEqual, 0)
+	})
+}
+
+func TestJimMessage(t *testing.T) {
+	Convey("Jim should delay messages within his limits", t, func() {
+		j := newJim(1)
+		j.DelayMessageChance, j.DelayMessageMin, j.DelayMessageMax = 1, time.Second, 2*time.Second
+		for i := 0; i < 10; i++ {
+			o := j.ReceivedMessage(&data.SMTPMessage{})
+			So(o.Delay, ShouldBeBetweenOrEqual, time.Second, 2*time.Second)
+			So(o.Reply, ShouldBeNil)
+		}
+	})
+
+	Convey("Jim should leave messages alone by default", t, func() {
+		So(newJim(1).ReceivedMessage(&data.SMTPMessage{}), ShouldBeNil)
+	})
+
+	Convey("Message faults without a chance shouldn't change Jim's other decisions", t, func() {
+		j := newJim(42)
+		expected := decisions(j, 10)
+
+		j = newJim(42)
+		var d []bool
+		for i := 0; i < 10; i++ {
+			s := j.ForSession().(*Jim)
+			So(s.DATAReply("from", []string{"to"}), ShouldBeNil)
+			So(s.ReceivedMessage(&data.SMTPMessage{}), ShouldBeNil)
+			d = append(d, s.Accept(nil), s.ValidMAIL("from"), s.ValidRCPT("to"), s.Disconnect())
+		}
+		So(d, ShouldResemble, expected)
+	})
+}
+
+func TestJimValidate(t *testing.T) {
+	Convey("Jim's settings should be validated", t, func() {
+		j := newJim(1)
+		j.LinkSpeedMin, j.LinkSpeedMax = 1024, 10240
+		So(j.Validate(), ShouldBeNil)
+
+		j.AcceptChance = 1.5
+		So(j.Validate(), ShouldNotBeNil)
+		j.AcceptChance = -0.1
+		So(j.Validate(), ShouldNotBeNil)
+		j.AcceptChance = 1
+
+		j.LinkSpeedMax = 100
+		So(j.Validate(), ShouldNotBeNil)
+		j.LinkSpeedMax = 10240
+
+		j.DelayMessageMin, j.DelayMessageMax = time.Minute, time.Second
+		So(j.Validate(), ShouldNotBeNil)
+		j.DelayMessageMin = 0
+
+		j.RejectSenderCodes = Codes{250}
+		So(j.Validate(), ShouldNotBeNil)
+		j.RejectSenderCodes = Codes{451}
+
+		j.ReplyDelays = Delays{"RCPT": {Distribution: "sometimes"}}
+		So(j.Validate(), ShouldNotBeNil)
+		j.ReplyDelays = Delays{"RCPT": {Distribution: DelayFixed, Min: time.Second}}
+		So(j.Validate(), ShouldBeNil)
+	})
+}
+
+func TestJimProtocol(t *testing.T) {
+	Convey("Protocol faults shouldn't change Jim's other decisions", t, func() {
+		j := newJim(42)
+		expected := decisions(j, 10)
+
+		j = newJim(42)
+		var d []bool
+		for i := 0; i < 10; i++ {
+			s := j.ForSession().(*Jim)
+			So(s.Command("EHLO", "test"), ShouldBeNil)
+			So(s.EHLOFault(), ShouldBeEmpty)
+			So(s.TruncateReply("EHLO", 3), ShouldEqual, 3)
+			d = append(d, s.Accept(nil), s.ValidMAIL("from"), s.ValidRCPT("to"), s.Disconnect())
+		}
+		So(d, ShouldResemble, expected)
+	})
+
+	Convey("Jim should choose protocol faults", t, func() {
+		j := newJim(1)
+		j.ShutdownChance, j.GarbleExtensionsChance, j.TruncateReplyChance = 1, 1, 1
+		j.RejectSTARTTLSChance, j.MismatchedCertificateChance = 1, 1
+
+		So(j.Command("QUIT", ""), ShouldBeNil)
+		r := j.Command("RCPT", "TO:<a@test>")
+		So(r.Code, ShouldEqual, 421)
+		So(r.Disconnect, ShouldBeTrue)
+		So(j.EHLOFault(), ShouldEqual, FaultGarbleExtensions)
+		So(j.STARTTLSReply().Code, ShouldEqual, 454)
+		So(j.CertificateFault(), ShouldEqual, FaultMismatchedCertificate)
+		So(j.TruncateReply("EHLO", 1), ShouldEqual, 1)
+		So(j.TruncateReply("EHLO", 3), ShouldBeBetween, 0, 3)
+	})
+}
@@ -2,8 +2,10 @@ package monkey
 
 import (
 	"net"
+	"time"
 
 	"github.com/ian-kent/linkio"
+	"github.com/mailhog/data"
 )
 
 // ChaosMonkey should be implemented by chaos monkeys!
@@ -26,3 +28,142 @@ type ChaosMonkey interface {
 	// Disconnect is called after every read. Returning true will close the connection.
 	Disconnect() bool
 }
+
+// SessionMonkey can be implemented by chaos monkeys which make each
+// connection's decisions independently of other connections, so they're
+// reproducible however sessions interleave
+type SessionMonkey interface {
+	// ForSession is called for each connection, in the order they're
+	// accepted. The monkey it returns is used for that connection.
+	ForSession() ChaosMonkey
+}
+
+// ForSession returns the monkey to use for a new connection
+func ForSession(m ChaosMonkey) ChaosMonkey {
+	if s, ok := m.(SessionMonkey); ok {
+		return s.ForSession()
+	}
+	return m
+}
+
+// indexedMonkey is implemented by SessionMonkeys which can return the
+// monkey for a particular session, so it can be rebuilt mid-session
+// without counting another session
+type indexedMonkey interface {
+	// nextSession counts a new session and returns its index
+	nextSession() uint64
+	// forSession returns the monkey for the nth session
+	forSession(n uint64) ChaosMonkey
+}
+
+// sessionIndex counts a new session of m and returns its index, or 0 if
+// m doesn't number its sessions
+func sessionIndex(m ChaosMonkey) uint64 {
+	if i, ok := m.(indexedMonkey); ok {
+		return i.nextSession()
+	}
+	return 0
+}
+
+// sessionAt returns the monkey for the nth session of m
+func sessionAt(m ChaosMonkey, n uint64) ChaosMonkey {
+	if i, ok := m.(indexedMonkey); ok {
+		return i.forSession(n)
+	}
+	return ForSession(m)
+}
+
+// CommandMonkey can be implemented by chaos monkeys which choose the
+// reply to SMTP commands themselves
+type CommandMonkey interface {
+	// Command is called before each SMTP command is processed, with the
+	// command's verb and arguments. Returning a reply sends it instead
+	// of processing the command.
+	Command(verb, args string) *Reply
+}
+
+// ReplyMonkey can be implemented by chaos monkeys which choose the reply
+// sent when they reject a sender, recipient or authentication. Its methods
+// are called in place of ValidMAIL, ValidRCPT and ValidAUTH.
+type ReplyMonkey interface {
+	// MAILReply is called for the MAIL command. Returning a reply rejects the sender.
+	MAILReply(mail string) *Reply
+	// RCPTReply is called for the RCPT command. Returning a reply rejects the recipient.
+	RCPTReply(rcpt string) *Reply
+	// AUTHReply is called after authentication. Returning a reply rejects the credentials.
+	AUTHReply(mechanism string, args ...string) *Reply
+}
+
+// MAILReply returns the reply m rejects a sender with, or nil if m
+// accepts it
+func MAILReply(m ChaosMonkey, mail string) *Reply {
+	if r, ok := m.(ReplyMonkey); ok {
+		return r.MAILReply(mail)
+	}
+	if m.ValidMAIL(mail) {
+		return nil
+	}
+	return &Reply{Code: 550, EnhancedCode: "5.1.0", Text: "Sender " + mail + " rejected"}
+}
+
+// RCPTReply returns the reply m rejects a recipient with, or nil if m
+// accepts it
+func RCPTReply(m ChaosMonkey, rcpt string) *Reply {
+	if r, ok := m.(ReplyMonkey); ok {
+		return r.RCPTReply(rcpt)
+	}
+	if m.ValidRCPT(rcpt) {
+		return nil
+	}
+	return &Reply{Code: 550, EnhancedCode: "5.1.1", Text: "Recipient " + rcpt + " rejected"}
+}
+
+// AUTHReply returns the reply m rejects authentication with, or nil if m
+// accepts it
+func AUTHReply(m ChaosMonkey, mechanism string, args ...string) *Reply {
+	if r, ok := m.(ReplyMonkey); ok {
+		return r.AUTHReply(mechanism, args...)
+	}
+	if m.ValidAUTH(mechanism, args...) {
+		return nil
+	}
+	return StandardReply(535)
+}
+
+// DataMonkey can be implemented by chaos monkeys which interfere with the
+// DATA phase
+type DataMonkey interface {
+	// DATAReply is called for the DATA command. Returning a reply rejects it.
+	DATAReply(from string, to []string) *Reply
+	// ReceivedMessage is called after the final dot of a message, before
+	// it's stored. Returning nil stores and acknowledges it as usual.
+	ReceivedMessage(msg *data.SMTPMessage) *Outcome
+}
+
+// Outcome is a chaos monkey's decision about a received message
+type Outcome struct {
+	// Delay is waited before the message is acknowledged or rejected
+	Delay time.Duration `json:"delay,omitempty"`
+	// Reply, if set, rejects the message without storing it
+	Reply *Reply `json:"reply,omitempty"`
+	// Discard acknowledges the message without storing it
+	Discard bool `json:"discard,omitempty"`
+	// Copies is the number of extra copies of the message stored
+	Copies int `json:"copies,omitempty"`
+}
+
+// Reply delay verbs for replies which don't answer a command
+const (
+	// VerbConnect is the verb used for the greeting
+	VerbConnect = "CONNECT"
+	// VerbEOD is the verb used for the reply after the final dot of a message
+	VerbEOD = "EOD"
+)
+
+// DelayMonkey can be implemented by chaos monkeys which delay replies
+type DelayMonkey interface {
+	// ReplyDelay is called before each reply is sent, with the verb of
+	// the command it answers, or VerbConnect or VerbEOD. The reply is sent
+	// after the delay it returns.
+	ReplyDelay(verb string) time.Duration
+}
@@ -0,0 +1,40 @@
+package monkey
+
+// Faults returned by ProtocolMonkey
+const (
+	// FaultDropExtensions replies to EHLO without any extensions
+	FaultDropExtensions = "drop"
+	// FaultGarbleExtensions replies to EHLO with extension lines clients
+	// can't parse
+	FaultGarbleExtensions = "garble"
+	// FaultExpiredCertificate serves a certificate which has expired
+	FaultExpiredCertificate = "expired"
+	// FaultMismatchedCertificate serves a certificate for another host
+	FaultMismatchedCertificate = "mismatched"
+)
+
+// ProtocolMonkey can be implemented by chaos monkeys which break the SMTP
+// protocol itself, rather than rejecting commands. A monkey can also end
+// a session in the middle with a 421 reply from CommandMonkey.Command.
+type ProtocolMonkey interface {
+	// EHLOFault is called for the EHLO command. It returns
+	// FaultDropExtensions or FaultGarbleExtensions to break the list of
+	// extensions, or an empty string to send it as usual.
+	EHLOFault() string
+	// STARTTLSReply is called for the STARTTLS command. Returning a reply
+	// refuses to start TLS, even though it was advertised.
+	STARTTLSReply() *Reply
+	// CertificateFault is called before the TLS handshake. It returns
+	// FaultExpiredCertificate or FaultMismatchedCertificate to serve a
+	// broken certificate, or an empty string to serve the usual one.
+	CertificateFault() string
+	// TruncateReply is called for replies of more than one line, with the
+	// verb of the command it answers. It returns the number of lines to
+	// send, and a reply with fewer lines than it has is cut short.
+	TruncateReply(verb string, lines int) int
+}
+
+// STARTTLSReply returns the reply used to refuse STARTTLS
+func STARTTLSReply() *Reply {
+	return &Reply{Code: 454, EnhancedCode: "4.7.0", Text: "TLS not available due to temporary reason"}
+}
@@ -0,0 +1,99 @@
+package monkey
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Reply is an SMTP reply chosen by a chaos monkey
+type Reply struct {
+	Code int `json:"code"`
+	// EnhancedCode is an RFC 3463 status code, e.g. "4.2.1", sent at the
+	// start of each line of the reply if it's set
+	EnhancedCode string `json:"enhancedCode,omitempty"`
+	Text         string `json:"text"`
+	// Disconnect closes the connection after the reply is sent. A reply
+	// with a zero Code closes the connection without sending anything.
+	Disconnect bool `json:"disconnect,omitempty"`
+}
+
+// Lines returns the reply formatted as SMTP reply lines, with Text split
+// into a multiline reply if it contains newlines
+func (r *Reply) Lines() []string {
+	if r.Code == 0 {
+		return nil
+	}
+	prefix := ""
+	if len(r.EnhancedCode) > 0 {
+		prefix = r.EnhancedCode + " "
+	}
+	text := strings.Split(r.Text, "\n")
+	lines := make([]string, len(text))
+	for i, t := range text {
+		sep := "-"
+		if i == len(text)-1 {
+			sep = " "
+		}
+		lines[i] = fmt.Sprintf("%d%s%s%s\r\n", r.Code, sep, prefix, strings.TrimRight(t, "\r"))
+	}
+	return lines
+}
+
+// standardReplies are the enhanced codes and text used by StandardReply
+var standardReplies = map[int]Reply{
+	421: {EnhancedCode: "4.3.2", Text: "Service not available, closing transmission channel", Disconnect: true},
+	450: {EnhancedCode: "4.2.1", Text: "Requested mail action not taken: mailbox unavailable"},
+	451: {EnhancedCode: "4.3.0", Text: "Requested action aborted: local error in processing"},
+	452: {EnhancedCode: "4.3.1", Text: "Requested action not taken: insufficient system storage"},
+	454: {EnhancedCode: "4.7.0", Text: "Temporary authentication failure"},
+	535: {EnhancedCode: "5.7.8", Text: "Authentication credentials invalid"},
+	550: {EnhancedCode: "5.7.1", Text: "Requested action not taken: mailbox unavailable"},
+	552: {EnhancedCode: "5.2.2", Text: "Requested mail action aborted: exceeded storage allocation"},
+	553: {EnhancedCode: "5.1.3", Text: "Requested action not taken: mailbox name not allowed"},
+	554: {EnhancedCode: "5.0.0", Text: "Transaction failed"},
+}
+
+// StandardReply returns a reply with the usual enhanced code and text for
+// code. 421 replies close the connection.
+func StandardReply(code int) *Reply {
+	r, ok := standardReplies[code]
+	if !ok {
+		r = Reply{EnhancedCode: fmt.Sprintf("%d.0.0", code/100), Text: "Requested action not taken"}
+	}
+	r.Code = code
+	return &r
+}
+
+// Codes is a list of SMTP reply codes, which can be set from a comma
+// separated flag
+type Codes []int
+
+var _ flag.Value = &Codes{}
+
+// String implements flag.Value.String
+func (c *Codes) String() string {
+	s := make([]string, len(*c))
+	for i, code := range *c {
+		s[i] = strconv.Itoa(code)
+	}
+	return strings.Join(s, ",")
+}
+
+// Set implements flag.Value.Set
+func (c *Codes) Set(s string) error {
+	var codes Codes
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 400 || code > 599 {
+			return fmt.Errorf("invalid reply code: %s", item)
+		}
+		codes = append(codes, code)
+	}
+	*c = codes
+	return nil
+}
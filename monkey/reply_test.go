@@ -0,0 +1,61 @@
+package monkey
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReplyLines(t *testing.T) {
+	Convey("Replies should be formatted with their enhanced code", t, func() {
+		So((&Reply{Code: 550, Text: "No"}).Lines(), ShouldResemble, []string{"550 No\r\n"})
+		So((&Reply{Code: 451, EnhancedCode: "4.3.0", Text: "Try\nlater"}).Lines(), ShouldResemble, []string{"451-4.3.0 Try\r\n", "451 4.3.0 later\r\n"})
+		So((&Reply{Disconnect: true}).Lines(), ShouldBeEmpty)
+	})
+
+	Convey("Standard replies should close the connection for 421", t, func() {
+		So(StandardReply(421).Disconnect, ShouldBeTrue)
+		So(StandardReply(452).EnhancedCode, ShouldEqual, "4.3.1")
+		So(StandardReply(499).EnhancedCode, ShouldEqual, "4.0.0")
+	})
+}
+
+func TestCodes(t *testing.T) {
+	Convey("Codes should be parsed from a comma separated list", t, func() {
+		var c Codes
+		So(c.Set("421, 451,550"), ShouldBeNil)
+		So(c, ShouldResemble, Codes{421, 451, 550})
+		So(c.String(), ShouldEqual, "421,451,550")
+		So(c.Set("250"), ShouldNotBeNil)
+		So(c.Set("abc"), ShouldNotBeNil)
+	})
+}
+
+func TestReplyMonkey(t *testing.T) {
+	Convey("Monkeys without replies should get default replies", t, func() {
+		// wrapping Jim hides everything but his ChaosMonkey methods
+		j := newJim(1)
+		m := struct{ ChaosMonkey }{j}
+		So(MAILReply(m, "a@test"), ShouldBeNil)
+
+		j.RejectSenderChance, j.RejectRecipientChance, j.RejectAuthChance = 1, 1, 1
+		j.RejectSenderCodes = Codes{451}
+		So(MAILReply(m, "a@test").Code, ShouldEqual, 550)
+		So(RCPTReply(m, "a@test").EnhancedCode, ShouldEqual, "5.1.1")
+		So(AUTHReply(m, "PLAIN").Code, ShouldEqual, 535)
+	})
+
+	Convey("Jim should reject with his configured codes", t, func() {
+		j := newJim(1)
+		j.RejectSenderChance = 1
+		j.RejectSenderCodes = Codes{421, 451}
+		for i := 0; i < 10; i++ {
+			r := j.MAILReply("a@test")
+			So(r.Code, ShouldBeIn, 421, 451)
+		}
+		So(j.ValidMAIL("a@test"), ShouldBeFalse)
+
+		j.RejectAuthChance = 1
+		So(j.AUTHReply("PLAIN").Code, ShouldEqual, 535)
+	})
+}
@@ -0,0 +1,576 @@
+package monkey
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ian-kent/linkio"
+	"github.com/mailhog/data"
+)
+
+// Stages of an SMTP session rules can match
+const (
+	StageConnect = "connect"
+	StageMAIL    = "mail"
+	StageRCPT    = "rcpt"
+	StageDATA    = "data"
+	StageAUTH    = "auth"
+	// StageMessage is after the final dot of a message
+	StageMessage = "message"
+)
+
+// Actions applied by matching rules
+const (
+	// ActionAccept processes the command normally, skipping later rules
+	ActionAccept = "accept"
+	// ActionReject sends the rule's reply instead of processing the command
+	ActionReject = "reject"
+	// ActionDisconnect closes the connection, after sending the rule's
+	// reply if it has a code
+	ActionDisconnect = "disconnect"
+)
+
+// defaultCodes are the reply codes used by reject rules without a code
+var defaultCodes = map[string]int{
+	StageConnect: 554,
+	StageMAIL:    550,
+	StageRCPT:    550,
+	StageDATA:    554,
+	StageAUTH:    535,
+	StageMessage: 554,
+}
+
+// ErrRuleNotFound is returned for unknown rules
+var ErrRuleNotFound = errors.New("rule not found")
+
+// Rule is a chaos rule applied at one stage of an SMTP session
+type Rule struct {
+	ID    string `json:"id"`
+	Stage string `json:"stage"`
+	// Address is matched against the sender at the mail, data and message
+	// stages, and the recipient at the rcpt stage. It's case insensitive and may
+	// contain * and ? wildcards, e.g. "*@billing.example".
+	Address string `json:"address,omitempty"`
+	// RemoteIP is an address or CIDR network the client must connect from
+	RemoteIP string `json:"remoteIP,omitempty"`
+	// After skips the first After attempts matching the rule, and Times,
+	// if set, stops applying it after that many more. Attempts are
+	// counted across sessions for each address, or each remote IP at the
+	// connect and auth stages.
+	After  int    `json:"after,omitempty"`
+	Times  int    `json:"times,omitempty"`
+	Action string `json:"action"`
+	// Code, EnhancedCode and Text are the reply sent by reject and
+	// disconnect rules. A 421 reply always closes the connection.
+	Code         int    `json:"code,omitempty"`
+	EnhancedCode string `json:"enhancedCode,omitempty"`
+	Text         string `json:"text,omitempty"`
+
+	network *net.IPNet
+}
+
+// compile validates the rule and parses its remote IP
+func (r *Rule) compile() error {
+	if _, ok := defaultCodes[r.Stage]; !ok {
+		return fmt.Errorf("invalid rule stage: %s", r.Stage)
+	}
+	switch r.Action {
+	case ActionAccept, ActionReject, ActionDisconnect:
+	default:
+		return fmt.Errorf("invalid rule action: %s", r.Action)
+	}
+	if r.Code != 0 && (r.Code < 200 || r.Code > 599) {
+		return fmt.Errorf("invalid rule reply code: %d", r.Code)
+	}
+	if len(r.EnhancedCode) > 0 && !validEnhancedCode(r.EnhancedCode) {
+		return fmt.Errorf("invalid rule enhanced status code: %s", r.EnhancedCode)
+	}
+	if r.After < 0 || r.Times < 0 {
+		return errors.New("rule after and times can't be negative")
+	}
+	if _, err := path.Match(r.Address, ""); err != nil {
+		return fmt.Errorf("invalid rule address pattern: %s", r.Address)
+	}
+
+	r.network = nil
+	if len(r.RemoteIP) > 0 {
+		s := r.RemoteIP
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid rule remote IP: %s", r.RemoteIP)
+		}
+		r.network = n
+	}
+	return nil
+}
+
+// matches returns true if the rule's conditions, other than its attempt
+// count, match
+func (r *Rule) matches(stage, address string, ip net.IP) bool {
+	if r.Stage != stage {
+		return false
+	}
+	if len(r.Address) > 0 {
+		if ok, _ := path.Match(strings.ToLower(r.Address), strings.ToLower(address)); !ok {
+			return false
+		}
+	}
+	if r.network != nil && (ip == nil || !r.network.Contains(ip)) {
+		return false
+	}
+	return true
+}
+
+// reply returns the reply sent when the rule is applied
+func (r *Rule) reply() *Reply {
+	switch r.Action {
+	case ActionReject:
+		reply := &Reply{Code: r.Code, EnhancedCode: r.EnhancedCode, Text: r.Text, Disconnect: r.Code == 421}
+		if reply.Code == 0 {
+			reply.Code = defaultCodes[r.Stage]
+		}
+		if len(reply.Text) == 0 {
+			reply.Text = "Rejected by rule " + r.ID
+		}
+		return reply
+	case ActionDisconnect:
+		reply := &Reply{Code: r.Code, EnhancedCode: r.EnhancedCode, Text: r.Text, Disconnect: true}
+		if reply.Code != 0 && len(reply.Text) == 0 {
+			reply.Text = "Disconnected by rule " + r.ID
+		}
+		return reply
+	}
+	return nil
+}
+
+// RuleSet is an ordered list of rules, shared by every session
+type RuleSet struct {
+	mu       sync.RWMutex
+	rules    []*Rule
+	attempts map[string]map[string]int
+}
+
+// NewRuleSet returns an empty RuleSet
+func NewRuleSet() *RuleSet {
+	return &RuleSet{attempts: make(map[string]map[string]int)}
+}
+
+// Len returns the number of rules
+func (s *RuleSet) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.rules)
+}
+
+// List returns the rules in order
+func (s *RuleSet) List() []*Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*Rule{}, s.rules...)
+}
+
+// Get returns a rule by ID
+func (s *RuleSet) Get(id string) (*Rule, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, r := range s.rules {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// Set validates and replaces every rule, resetting attempt counts
+func (s *RuleSet) Set(rules []*Rule) error {
+	ids := make(map[string]bool)
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			return err
+		}
+		if len(r.ID) == 0 {
+			r.ID = newRuleID()
+		}
+		if ids[r.ID] {
+			return fmt.Errorf("duplicate rule id: %s", r.ID)
+		}
+		ids[r.ID] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = append([]*Rule{}, rules...)
+	s.attempts = make(map[string]map[string]int)
+	return nil
+}
+
+// Add validates a rule and adds it to the end of the list, assigning it
+// an ID if it doesn't have one
+func (s *RuleSet) Add(r *Rule) error {
+	if err := r.compile(); err != nil {
+		return err
+	}
+	if len(r.ID) == 0 {
+		r.ID = newRuleID()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.rules {
+		if o.ID == r.ID {
+			return fmt.Errorf("duplicate rule id: %s", r.ID)
+		}
+	}
+	s.rules = append(s.rules, r)
+	return nil
+}
+
+// Update replaces an existing rule in place, resetting its attempt counts
+func (s *RuleSet) Update(id string, r *Rule) error {
+	if err := r.compile(); err != nil {
+		return err
+	}
+	r.ID = id
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, o := range s.rules {
+		if o.ID == id {
+			s.rules[i] = r
+			delete(s.attempts, id)
+			return nil
+		}
+	}
+	return ErrRuleNotFound
+}
+
+// Remove deletes a rule
+func (s *RuleSet) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.rules {
+		if r.ID == id {
+			s.rules = append(s.rules[:i], s.rules[i+1:]...)
+			delete(s.attempts, id)
+			return nil
+		}
+	}
+	return ErrRuleNotFound
+}
+
+// apply returns the first rule applying to a command, counting an
+// attempt against each rule it matches up to and including that one
+func (s *RuleSet) apply(stage, address string, ip net.IP) *Rule {
+	key := strings.ToLower(address)
+	if stage == StageConnect || stage == StageAUTH {
+		key = ip.String()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.rules {
+		if !r.matches(stage, address, ip) {
+			continue
+		}
+		if s.attempts[r.ID] == nil {
+			s.attempts[r.ID] = make(map[string]int)
+		}
+		s.attempts[r.ID][key]++
+		n := s.attempts[r.ID][key]
+		if n <= r.After || (r.Times > 0 && n > r.After+r.Times) {
+			continue
+		}
+		return r
+	}
+	return nil
+}
+
+// validEnhancedCode returns true if s is an RFC 3463 status code matching
+// class.subject.detail, e.g. "5.1.1"
+func validEnhancedCode(s string) bool {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 || (parts[0] != "2" && parts[0] != "4" && parts[0] != "5") {
+		return false
+	}
+	for _, p := range parts[1:] {
+		if len(p) == 0 || len(p) > 3 || strings.Trim(p, "0123456789") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadRules reads a JSON array of rules from file
+func LoadRules(file string) ([]*Rule, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*Rule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func newRuleID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Rules is a chaos monkey which applies a RuleSet, leaving anything the
+// rules don't decide to its Fallback
+type Rules struct {
+	Set *RuleSet
+	// Fallback, if set, is used for connections, commands and decisions
+	// no rule applies to
+	Fallback ChaosMonkey
+
+	// remoteIP and sender are set during a session
+	remoteIP net.IP
+	sender   string
+	// accepted is the stage of the current command if an accept rule
+	// matched it, so the fallback isn't asked to reply to it
+	accepted string
+}
+
+// RegisterFlags implements ChaosMonkey.RegisterFlags
+func (r *Rules) RegisterFlags() {}
+
+// Configure implements ChaosMonkey.Configure
+func (r *Rules) Configure(logf func(string, ...interface{})) {}
+
+// ForSession implements SessionMonkey.ForSession
+func (r *Rules) ForSession() ChaosMonkey {
+	return &Rules{Set: r.Set, Fallback: ForSession(r.Fallback)}
+}
+
+func (r *Rules) nextSession() uint64 {
+	return sessionIndex(r.Fallback)
+}
+
+func (r *Rules) forSession(n uint64) ChaosMonkey {
+	return &Rules{Set: r.Set, Fallback: sessionAt(r.Fallback, n)}
+}
+
+func (r *Rules) resume(remoteIP net.IP, sender string) {
+	r.remoteIP, r.sender = remoteIP, sender
+	if f, ok := r.Fallback.(resumer); ok {
+		f.resume(remoteIP, sender)
+	}
+}
+
+// Accept implements ChaosMonkey.Accept
+//
+// A connection rejected by a rule with a reply code is sent the reply
+// before it's closed.
+func (r *Rules) Accept(conn net.Conn) bool {
+	if conn != nil {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			r.remoteIP = addr.IP
+		}
+	}
+
+	rule := r.Set.apply(StageConnect, "", r.remoteIP)
+	if rule == nil {
+		return r.Fallback == nil || r.Fallback.Accept(conn)
+	}
+	slog.Info("Applying chaos rule", "monkey", "rules", "rule", rule.ID, "stage", StageConnect, "action", rule.Action, "remote", r.remoteIP)
+	reply := rule.reply()
+	if reply == nil {
+		return true
+	}
+	if conn != nil {
+		for _, l := range reply.Lines() {
+			conn.Write([]byte(l))
+		}
+	}
+	return false
+}
+
+// LinkSpeed implements ChaosMonkey.LinkSpeed
+func (r *Rules) LinkSpeed() *linkio.Throughput {
+	if r.Fallback == nil {
+		return nil
+	}
+	return r.Fallback.LinkSpeed()
+}
+
+// Command implements CommandMonkey.Command
+func (r *Rules) Command(verb, args string) *Reply {
+	var stage, address string
+	switch strings.ToUpper(verb) {
+	case "MAIL":
+		stage, address = StageMAIL, envelopeAddress(args)
+		r.sender = address
+	case "RCPT":
+		stage, address = StageRCPT, envelopeAddress(args)
+	case "DATA":
+		stage, address = StageDATA, r.sender
+	case "AUTH":
+		stage = StageAUTH
+	}
+
+	r.accepted = ""
+	if len(stage) > 0 {
+		if rule := r.Set.apply(stage, address, r.remoteIP); rule != nil {
+			if rule.Action == ActionAccept {
+				r.accepted = stage
+			}
+			slog.Info("Applying chaos rule", "monkey", "rules", "rule", rule.ID, "stage", stage, "action", rule.Action, "address", address, "remote", r.remoteIP)
+			return rule.reply()
+		}
+	}
+	if c, ok := r.Fallback.(CommandMonkey); ok {
+		return c.Command(verb, args)
+	}
+	return nil
+}
+
+// DATAReply implements DataMonkey.DATAReply
+//
+// Rules for the DATA command are applied by Command, so this only asks
+// the fallback, unless an accept rule matched.
+func (r *Rules) DATAReply(from string, to []string) *Reply {
+	if r.accepted == StageDATA {
+		return nil
+	}
+	if d, ok := r.Fallback.(DataMonkey); ok {
+		return d.DATAReply(from, to)
+	}
+	return nil
+}
+
+// ReceivedMessage implements DataMonkey.ReceivedMessage
+func (r *Rules) ReceivedMessage(msg *data.SMTPMessage) *Outcome {
+	if rule := r.Set.apply(StageMessage, r.sender, r.remoteIP); rule != nil {
+		slog.Info("Applying chaos rule", "monkey", "rules", "rule", rule.ID, "stage", StageMessage, "action", rule.Action, "address", r.sender, "remote", r.remoteIP)
+		if reply := rule.reply(); reply != nil {
+			return &Outcome{Reply: reply}
+		}
+		return nil
+	}
+	if d, ok := r.Fallback.(DataMonkey); ok {
+		return d.ReceivedMessage(msg)
+	}
+	return nil
+}
+
+// ReplyDelay implements DelayMonkey.ReplyDelay
+func (r *Rules) ReplyDelay(verb string) time.Duration {
+	if d, ok := r.Fallback.(DelayMonkey); ok {
+		return d.ReplyDelay(verb)
+	}
+	return 0
+}
+
+// MAILReply implements ReplyMonkey.MAILReply
+//
+// Rules for the MAIL, RCPT and AUTH commands are applied by Command, so
+// the reply methods only ask the fallback, unless an accept rule matched.
+func (r *Rules) MAILReply(mail string) *Reply {
+	if r.Fallback == nil || r.accepted == StageMAIL {
+		return nil
+	}
+	return MAILReply(r.Fallback, mail)
+}
+
+// RCPTReply implements ReplyMonkey.RCPTReply
+func (r *Rules) RCPTReply(rcpt string) *Reply {
+	if r.Fallback == nil || r.accepted == StageRCPT {
+		return nil
+	}
+	return RCPTReply(r.Fallback, rcpt)
+}
+
+// AUTHReply implements ReplyMonkey.AUTHReply
+func (r *Rules) AUTHReply(mechanism string, args ...string) *Reply {
+	if r.Fallback == nil || r.accepted == StageAUTH {
+		return nil
+	}
+	return AUTHReply(r.Fallback, mechanism, args...)
+}
+
+// ValidRCPT implements ChaosMonkey.ValidRCPT
+func (r *Rules) ValidRCPT(rcpt string) bool {
+	return r.RCPTReply(rcpt) == nil
+}
+
+// ValidMAIL implements ChaosMonkey.ValidMAIL
+func (r *Rules) ValidMAIL(mail string) bool {
+	return r.MAILReply(mail) == nil
+}
+
+// ValidAUTH implements ChaosMonkey.ValidAUTH
+func (r *Rules) ValidAUTH(mechanism string, args ...string) bool {
+	return r.AUTHReply(mechanism, args...) == nil
+}
+
+// Disconnect implements ChaosMonkey.Disconnect
+func (r *Rules) Disconnect() bool {
+	return r.Fallback != nil && r.Fallback.Disconnect()
+}
+
+// EHLOFault implements ProtocolMonkey.EHLOFault
+func (r *Rules) EHLOFault() string {
+	if p, ok := r.Fallback.(ProtocolMonkey); ok {
+		return p.EHLOFault()
+	}
+	return ""
+}
+
+// STARTTLSReply implements ProtocolMonkey.STARTTLSReply
+func (r *Rules) STARTTLSReply() *Reply {
+	if p, ok := r.Fallback.(ProtocolMonkey); ok {
+		return p.STARTTLSReply()
+	}
+	return nil
+}
+
+// CertificateFault implements ProtocolMonkey.CertificateFault
+func (r *Rules) CertificateFault() string {
+	if p, ok := r.Fallback.(ProtocolMonkey); ok {
+		return p.CertificateFault()
+	}
+	return ""
+}
+
+// TruncateReply implements ProtocolMonkey.TruncateReply
+func (r *Rules) TruncateReply(verb string, lines int) int {
+	if p, ok := r.Fallback.(ProtocolMonkey); ok {
+		return p.TruncateReply(verb, lines)
+	}
+	return lines
+}
+
+// envelopeAddress returns the address in MAIL FROM or RCPT TO arguments,
+// e.g. "a@example.com" from "FROM:<a@example.com> SIZE=100"
+func envelopeAddress(args string) string {
+	start := strings.Index(args, "<")
+	end := strings.Index(args, ">")
+	if start < 0 || end < start {
+		if i := strings.Index(args, ":"); i >= 0 {
+			return strings.TrimSpace(args[i+1:])
+		}
+		return strings.TrimSpace(args)
+	}
+	return args[start+1 : end]
+}
@@ -0,0 +1,130 @@
+package monkey
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newRules(rules ...*Rule) *Rules {
+	s := NewRuleSet()
+	So(s.Set(rules), ShouldBeNil)
+	return &Rules{Set: s}
+}
+
+func TestRuleValidation(t *testing.T) {
+	Convey("Invalid rules should be rejected", t, func() {
+		s := NewRuleSet()
+		So(s.Add(&Rule{Stage: "helo", Action: ActionReject}), ShouldNotBeNil)
+		So(s.Add(&Rule{Stage: StageRCPT, Action: "bounce"}), ShouldNotBeNil)
+		So(s.Add(&Rule{Stage: StageRCPT, Action: ActionReject, Code: 999}), ShouldNotBeNil)
+		So(s.Add(&Rule{Stage: StageRCPT, Action: ActionReject, Address: "[a"}), ShouldNotBeNil)
+		So(s.Add(&Rule{Stage: StageRCPT, Action: ActionReject, RemoteIP: "nope"}), ShouldNotBeNil)
+		So(s.Len(), ShouldEqual, 0)
+
+		r := &Rule{Stage: StageRCPT, Action: ActionReject, RemoteIP: "10.0.0.1"}
+		So(s.Add(r), ShouldBeNil)
+		So(r.ID, ShouldNotBeEmpty)
+		So(s.Len(), ShouldEqual, 1)
+	})
+
+	Convey("Duplicate rule IDs should be rejected", t, func() {
+		s := NewRuleSet()
+		So(s.Set([]*Rule{
+			{ID: "a", Stage: StageRCPT, Action: ActionReject},
+			{ID: "a", Stage: StageMAIL, Action: ActionReject},
+		}), ShouldNotBeNil)
+		So(s.Len(), ShouldEqual, 0)
+
+		So(s.Add(&Rule{ID: "a", Stage: StageRCPT, Action: ActionReject}), ShouldBeNil)
+		So(s.Add(&Rule{ID: "a", Stage: StageMAIL, Action: ActionReject}), ShouldNotBeNil)
+		So(s.Len(), ShouldEqual, 1)
+	})
+}
+
+func TestRules(t *testing.T) {
+	Convey("Rules should match addresses case insensitively", t, func() {
+		r := newRules(&Rule{ID: "a", Stage: StageRCPT, Address: "bounce@*", Action: ActionReject, Code: 550, Text: "No such user"})
+		So(r.Command("RCPT", "TO:<BOUNCE@test.example>"), ShouldResemble, &Reply{Code: 550, Text: "No such user"})
+		So(r.Command("RCPT", "TO:<other@test.example>"), ShouldBeNil)
+		So(r.Command("MAIL", "FROM:<bounce@test.example>"), ShouldBeNil)
+	})
+
+	Convey("Rules should use a default code and text", t, func() {
+		r := newRules(&Rule{ID: "a", Stage: StageMAIL, Action: ActionReject})
+		So(r.Command("MAIL", "FROM:<a@test.example> SIZE=10"), ShouldResemble, &Reply{Code: 550, Text: "Rejected by rule a"})
+	})
+
+	Convey("Rules should apply after and times per address", t, func() {
+		r := newRules(&Rule{ID: "a", Stage: StageRCPT, Address: "slow@*", Action: ActionReject, Code: 451, Times: 2})
+		So(r.Command("RCPT", "TO:<slow@test>"), ShouldNotBeNil)
+		So(r.Command("RCPT", "TO:<slow@other>"), ShouldNotBeNil)
+		So(r.Command("RCPT", "TO:<slow@test>"), ShouldNotBeNil)
+		So(r.Command("RCPT", "TO:<slow@test>"), ShouldBeNil)
+
+		r = newRules(&Rule{ID: "a", Stage: StageRCPT, Action: ActionReject, After: 1})
+		So(r.Command("RCPT", "TO:<a@test>"), ShouldBeNil)
+		So(r.Command("RCPT", "TO:<a@test>"), ShouldNotBeNil)
+	})
+
+	Convey("Rules should be applied in order", t, func() {
+		r := newRules(
+			&Rule{ID: "a", Stage: StageRCPT, Address: "vip@*", Action: ActionAccept},
+			&Rule{ID: "b", Stage: StageRCPT, Action: ActionReject},
+		)
+		So(r.Command("RCPT", "TO:<vip@test>"), ShouldBeNil)
+		So(r.Command("RCPT", "TO:<a@test>"), ShouldNotBeNil)
+	})
+
+	Convey("Data rules should match the sender", t, func() {
+		r := newRules(&Rule{ID: "a", Stage: StageDATA, Address: "*@billing", Action: ActionDisconnect})
+		s := r.ForSession().(*Rules)
+		So(s.Command("MAIL", "FROM:<a@billing>"), ShouldBeNil)
+		So(s.Command("DATA", ""), ShouldResemble, &Reply{Disconnect: true})
+
+		s = r.ForSession().(*Rules)
+		So(s.Command("MAIL", "FROM:<a@test>"), ShouldBeNil)
+		So(s.Command("DATA", ""), ShouldBeNil)
+	})
+
+	Convey("Rules should match the remote IP", t, func() {
+		r := newRules(&Rule{ID: "a", Stage: StageConnect, RemoteIP: "10.0.0.0/8", Action: ActionReject})
+		s := r.ForSession().(*Rules)
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		So(s.Accept(&addrConn{c1, &net.TCPAddr{IP: net.ParseIP("192.168.0.1")}}), ShouldBeTrue)
+
+		s = r.ForSession().(*Rules)
+		go c2.Read(make([]byte, 100))
+		So(s.Accept(&addrConn{c1, &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}}), ShouldBeFalse)
+	})
+
+	Convey("Rules should fall back to another monkey", t, func() {
+		r := newRules(&Rule{ID: "a", Stage: StageRCPT, Address: "x@*", Action: ActionReject})
+		r.Fallback = newJim(1)
+		r.Fallback.(*Jim).RejectRecipientChance = 1
+		So(r.Command("RCPT", "TO:<x@test>"), ShouldNotBeNil)
+		So(r.ValidRCPT("y@test"), ShouldBeFalse)
+	})
+}
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestRulesMessage(t *testing.T) {
+	Convey("Message rules should match the sender after the final dot", t, func() {
+		r := newRules(&Rule{ID: "a", Stage: StageMessage, Address: "*@billing", Action: ActionReject, Code: 451})
+		s := r.ForSession().(*Rules)
+		s.Command("MAIL", "FROM:<a@billing>")
+		So(s.ReceivedMessage(nil), ShouldResemble, &Outcome{Reply: &Reply{Code: 451, Text: "Rejected by rule a"}})
+
+		s = r.ForSession().(*Rules)
+		s.Command("MAIL", "FROM:<a@test>")
+		So(s.ReceivedMessage(nil), ShouldBeNil)
+	})
+}
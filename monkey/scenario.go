@@ -0,0 +1,372 @@
+package monkey
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// ErrNoScenario is returned when no scenario is loaded
+var ErrNoScenario = errors.New("no scenario loaded")
+
+// ErrPhaseNotFound is returned for unknown scenario phases
+var ErrPhaseNotFound = errors.New("phase not found")
+
+// Duration is a time.Duration written in JSON as a string, e.g. "5m".
+// Numbers of nanoseconds are also accepted.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("invalid duration: %s", b)
+		}
+		*d = Duration(n)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration: %s", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Phase is a period of a scenario with its own chaos settings
+type Phase struct {
+	Name string `json:"name"`
+	// Start is the time after the scenario starts the phase begins. End,
+	// if set, is when it ends, otherwise it lasts until the next phase
+	// starts, or forever if it's the last phase.
+	Start Duration `json:"start"`
+	End   Duration `json:"end,omitempty"`
+	// Jim, if set, are Jim settings used during the phase. Settings it
+	// doesn't include are the ones Jim had when the scenario was loaded.
+	Jim json.RawMessage `json:"jim,omitempty"`
+	// Rules, if set, replace the chaos rules during the phase. An empty
+	// list disables them.
+	Rules []*Rule `json:"rules,omitempty"`
+
+	end   time.Duration
+	jim   *Jim
+	rules *RuleSet
+}
+
+// Monkey returns the Jim used during the phase, or nil if the phase
+// doesn't change Jim
+func (p *Phase) Monkey() ChaosMonkey {
+	if p.jim == nil {
+		return nil
+	}
+	return p.jim
+}
+
+// RuleSet returns the rules used during the phase, or nil if the phase
+// doesn't change them
+func (p *Phase) RuleSet() *RuleSet {
+	return p.rules
+}
+
+// Scenario is a timeline of phases, e.g. rejecting half of all
+// connections from minute 5 to minute 10 of a test
+type Scenario struct {
+	Name   string   `json:"name"`
+	Phases []*Phase `json:"phases"`
+}
+
+// compile validates the scenario and prepares each phase's monkey and
+// rules, starting from the settings of base
+func (s *Scenario) compile(base *Jim) error {
+	if len(s.Phases) == 0 {
+		return errors.New("scenario has no phases")
+	}
+	names := make(map[string]bool)
+	for i, p := range s.Phases {
+		if len(p.Name) == 0 {
+			return fmt.Errorf("scenario phase %d has no name", i+1)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("scenario phase %s is duplicated", p.Name)
+		}
+		names[p.Name] = true
+
+		if p.Start < 0 {
+			return fmt.Errorf("scenario phase %s starts before the scenario", p.Name)
+		}
+		if i > 0 && p.Start < s.Phases[i-1].Start {
+			return fmt.Errorf("scenario phase %s starts before the phase preceding it", p.Name)
+		}
+		if p.End != 0 && p.End <= p.Start {
+			return fmt.Errorf("scenario phase %s ends before it starts", p.Name)
+		}
+		p.end = time.Duration(p.End)
+		if p.end == 0 && i < len(s.Phases)-1 {
+			p.end = time.Duration(s.Phases[i+1].Start)
+		}
+
+		p.jim = nil
+		if len(p.Jim) > 0 {
+			j := &Jim{}
+			if base != nil {
+				*j = *base
+			}
+			if err := json.Unmarshal(p.Jim, j); err != nil {
+				return fmt.Errorf("scenario phase %s has invalid Jim settings: %s", p.Name, err)
+			}
+			if err := j.Validate(); err != nil {
+				return fmt.Errorf("scenario phase %s has invalid Jim settings: %s", p.Name, err)
+			}
+			if base != nil {
+				j.ConfigureFrom(base)
+			} else {
+				j.Configure(func(string, ...interface{}) {})
+			}
+			p.jim = j
+		}
+
+		p.rules = nil
+		if p.Rules != nil {
+			p.rules = NewRuleSet()
+			if err := p.rules.Set(p.Rules); err != nil {
+				return fmt.Errorf("scenario phase %s: %s", p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// phaseAt returns the phase active at elapsed, or nil if none is
+func (s *Scenario) phaseAt(elapsed time.Duration) *Phase {
+	for _, p := range s.Phases {
+		if elapsed >= time.Duration(p.Start) && (p.end == 0 || elapsed < p.end) {
+			return p
+		}
+	}
+	return nil
+}
+
+// nextChange returns the first time after elapsed a phase starts or
+// ends, and false if there isn't one
+func (s *Scenario) nextChange(elapsed time.Duration) (time.Duration, bool) {
+	var next time.Duration
+	found := false
+	for _, p := range s.Phases {
+		for _, t := range []time.Duration{time.Duration(p.Start), p.end} {
+			if t > elapsed && (!found || t < next) {
+				next, found = t, true
+			}
+		}
+	}
+	return next, found
+}
+
+// LoadScenario reads a JSON scenario from file
+func LoadScenario(file string) (*Scenario, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var s Scenario
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ScenarioStatus describes the scenario loaded into a ScenarioRunner
+type ScenarioStatus struct {
+	Name string `json:"name"`
+	// Running is true from when the schedule is started until it's
+	// stopped, and Finished is true once it has no more changes to make
+	Running  bool       `json:"running"`
+	Finished bool       `json:"finished,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Elapsed  Duration   `json:"elapsed,omitempty"`
+	// Phase is the active phase, if any, and Manual is true if it was
+	// activated on demand rather than by the schedule
+	Phase    string    `json:"phase,omitempty"`
+	Manual   bool      `json:"manual,omitempty"`
+	Scenario *Scenario `json:"scenario"`
+}
+
+// ScenarioRunner activates the phases of a scenario on schedule, or on
+// demand
+type ScenarioRunner struct {
+	mu       sync.Mutex
+	scenario *Scenario
+	started  time.Time
+	phase    *Phase
+	manual   bool
+	timer    *time.Timer
+	// gen is incremented whenever the schedule changes, so timers from an
+	// earlier schedule are ignored
+	gen    int
+	notify func(*ScenarioStatus)
+}
+
+// NewScenarioRunner returns a ScenarioRunner without a scenario
+func NewScenarioRunner() *ScenarioRunner {
+	return &ScenarioRunner{}
+}
+
+// Notify sets a function called with the runner's status whenever the
+// active phase changes
+func (r *ScenarioRunner) Notify(f func(*ScenarioStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notify = f
+}
+
+// Load validates a scenario and replaces any loaded scenario with it. Its
+// phases' Jim settings are applied on top of base's. It isn't started.
+func (r *ScenarioRunner) Load(s *Scenario, base *Jim) error {
+	if err := s.compile(base); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.stop()
+	r.scenario = s
+	r.mu.Unlock()
+	r.changed()
+	return nil
+}
+
+// Unload stops and removes the loaded scenario
+func (r *ScenarioRunner) Unload() {
+	r.mu.Lock()
+	r.stop()
+	r.scenario = nil
+	r.mu.Unlock()
+	r.changed()
+}
+
+// Start starts the loaded scenario's schedule from the beginning
+func (r *ScenarioRunner) Start() error {
+	r.mu.Lock()
+	if r.scenario == nil {
+		r.mu.Unlock()
+		return ErrNoScenario
+	}
+	r.stop()
+	r.started = time.Now()
+	r.advance()
+	r.mu.Unlock()
+	r.changed()
+	return nil
+}
+
+// Stop stops the schedule and deactivates the active phase
+func (r *ScenarioRunner) Stop() {
+	r.mu.Lock()
+	r.stop()
+	r.mu.Unlock()
+	r.changed()
+}
+
+// Activate stops the schedule and activates a phase until another phase
+// is activated or the runner is stopped
+func (r *ScenarioRunner) Activate(name string) error {
+	r.mu.Lock()
+	if r.scenario == nil {
+		r.mu.Unlock()
+		return ErrNoScenario
+	}
+	for _, p := range r.scenario.Phases {
+		if p.Name == name {
+			r.stop()
+			r.phase, r.manual = p, true
+			r.mu.Unlock()
+			r.changed()
+			return nil
+		}
+	}
+	r.mu.Unlock()
+	return ErrPhaseNotFound
+}
+
+// Current returns the active phase, or nil if none is
+func (r *ScenarioRunner) Current() *Phase {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.phase
+}
+
+// Status returns the runner's status, or nil if no scenario is loaded
+func (r *ScenarioRunner) Status() *ScenarioStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status()
+}
+
+func (r *ScenarioRunner) status() *ScenarioStatus {
+	if r.scenario == nil {
+		return nil
+	}
+	s := &ScenarioStatus{Name: r.scenario.Name, Manual: r.manual, Scenario: r.scenario}
+	if r.phase != nil {
+		s.Phase = r.phase.Name
+	}
+	if !r.started.IsZero() {
+		started := r.started
+		s.Running = true
+		s.Finished = r.timer == nil
+		s.Started = &started
+		s.Elapsed = Duration(time.Since(r.started))
+	}
+	return s
+}
+
+// stop cancels the schedule. It's called with r.mu held.
+func (r *ScenarioRunner) stop() {
+	r.gen++
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.started = time.Time{}
+	r.phase, r.manual = nil, false
+}
+
+// advance activates the phase scheduled for now and schedules the next
+// change. It's called with r.mu held.
+func (r *ScenarioRunner) advance() {
+	elapsed := time.Since(r.started)
+	r.phase = r.scenario.phaseAt(elapsed)
+	r.timer = nil
+	if next, ok := r.scenario.nextChange(elapsed); ok {
+		gen := r.gen
+		r.timer = time.AfterFunc(next-elapsed, func() { r.tick(gen) })
+	}
+}
+
+func (r *ScenarioRunner) tick(gen int) {
+	r.mu.Lock()
+	if gen != r.gen {
+		r.mu.Unlock()
+		return
+	}
+	r.advance()
+	r.mu.Unlock()
+	r.changed()
+}
+
+// changed calls the notify function with the runner's status
+func (r *ScenarioRunner) changed() {
+	r.mu.Lock()
+	notify, status := r.notify, r.status()
+	r.mu.Unlock()
+	if notify != nil {
+		notify(status)
+	}
+}
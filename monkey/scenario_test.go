@@ -0,0 +1,121 @@
+package monkey
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func parseScenario(s string) *Scenario {
+	var scenario Scenario
+	if err := json.Unmarshal([]byte(s), &scenario); err != nil {
+		panic(err)
+	}
+	return &scenario
+}
+
+func TestScenario(t *testing.T) {
+	Convey("Phases should overlay Jim's settings and replace rules", t, func() {
+		s := parseScenario(`{"name": "outage", "phases": [
+			{"name": "calm", "start": "0s", "rules": []},
+			{"name": "storm", "start": "5m", "end": "10m", "jim": {"AcceptChance": 0.5}},
+			{"name": "after", "start": "15m"}
+		]}`)
+		So(s.compile(newJim(1)), ShouldBeNil)
+
+		calm, storm, after := s.Phases[0], s.Phases[1], s.Phases[2]
+		So(calm.Monkey(), ShouldBeNil)
+		So(calm.RuleSet(), ShouldNotBeNil)
+		So(calm.RuleSet().Len(), ShouldEqual, 0)
+		So(storm.Monkey(), ShouldNotBeNil)
+		So(storm.jim.AcceptChance, ShouldEqual, 0.5)
+		So(storm.jim.RejectSenderChance, ShouldEqual, 0.5)
+		So(storm.RuleSet(), ShouldBeNil)
+		So(after.Monkey(), ShouldBeNil)
+
+		So(s.phaseAt(time.Minute), ShouldEqual, calm)
+		So(s.phaseAt(5*time.Minute), ShouldEqual, storm)
+		So(s.phaseAt(12*time.Minute), ShouldBeNil)
+		So(s.phaseAt(time.Hour), ShouldEqual, after)
+
+		next, ok := s.nextChange(time.Minute)
+		So(ok, ShouldBeTrue)
+		So(next, ShouldEqual, 5*time.Minute)
+		next, _ = s.nextChange(5 * time.Minute)
+		So(next, ShouldEqual, 10*time.Minute)
+		_, ok = s.nextChange(time.Hour)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Invalid scenarios should be rejected", t, func() {
+		So(parseScenario(`{"phases": []}`).compile(nil), ShouldNotBeNil)
+		So(parseScenario(`{"phases": [{"start": "1m"}]}`).compile(nil), ShouldNotBeNil)
+		So(parseScenario(`{"phases": [{"name": "a"}, {"name": "a"}]}`).compile(nil), ShouldNotBeNil)
+		So(parseScenario(`{"phases": [{"name": "a", "start": "2m"}, {"name": "b", "start": "1m"}]}`).compile(nil), ShouldNotBeNil)
+		So(parseScenario(`{"phases": [{"name": "a", "start": "2m", "end": "1m"}]}`).compile(nil), ShouldNotBeNil)
+		So(parseScenario(`{"phases": [{"name": "a", "jim": {"AcceptChance": "x"}}]}`).compile(nil), ShouldNotBeNil)
+		So(parseScenario(`{"phases": [{"name": "a", "rules": [{"stage": "nope"}]}]}`).compile(nil), ShouldNotBeNil)
+		So(parseScenario(`{"phases": [{"name": "a", "start": 60000000000}]}`).compile(nil), ShouldBeNil)
+	})
+
+	Convey("The runner should activate phases on schedule and on demand", t, func() {
+		r := NewScenarioRunner()
+		changes := make(chan *ScenarioStatus, 10)
+		r.Notify(func(s *ScenarioStatus) { changes <- s })
+
+		So(r.Status(), ShouldBeNil)
+		So(r.Start(), ShouldEqual, ErrNoScenario)
+
+		s := parseScenario(`{"name": "blip", "phases": [
+			{"name": "first", "start": "0s", "end": "50ms", "jim": {}},
+			{"name": "second", "start": "50ms", "end": "100ms"}
+		]}`)
+		So(r.Load(s, newJim(1)), ShouldBeNil)
+		So((<-changes).Phase, ShouldEqual, "")
+
+		So(r.Start(), ShouldBeNil)
+		status := <-changes
+		So(status.Running, ShouldBeTrue)
+		So(status.Finished, ShouldBeFalse)
+		So(status.Phase, ShouldEqual, "first")
+		So(r.Current(), ShouldEqual, s.Phases[0])
+
+		So((<-changes).Phase, ShouldEqual, "second")
+		status = <-changes
+		So(status.Phase, ShouldEqual, "")
+		So(status.Running, ShouldBeTrue)
+		So(status.Finished, ShouldBeTrue)
+		So(r.Current(), ShouldBeNil)
+
+		So(r.Activate("nope"), ShouldEqual, ErrPhaseNotFound)
+		So(r.Activate("second"), ShouldBeNil)
+		status = <-changes
+		So(status.Phase, ShouldEqual, "second")
+		So(status.Manual, ShouldBeTrue)
+		So(status.Running, ShouldBeFalse)
+
+		r.Stop()
+		So((<-changes).Phase, ShouldEqual, "")
+		So(r.Current(), ShouldBeNil)
+
+		r.Unload()
+		So(<-changes, ShouldBeNil)
+		So(r.Status(), ShouldBeNil)
+	})
+
+	Convey("The runner should be running while an open-ended phase is active", t, func() {
+		r := NewScenarioRunner()
+		So(r.Load(parseScenario(`{"name": "outage", "phases": [{"name": "down", "start": "0s"}]}`), newJim(1)), ShouldBeNil)
+		So(r.Start(), ShouldBeNil)
+
+		status := r.Status()
+		So(status.Phase, ShouldEqual, "down")
+		So(status.Running, ShouldBeTrue)
+		So(status.Finished, ShouldBeTrue)
+
+		r.Stop()
+		So(r.Status().Running, ShouldBeFalse)
+	})
+}
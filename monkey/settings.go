@@ -0,0 +1,143 @@
+package monkey
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Profiles are named sets of Jim's settings, which can be chosen at
+// startup instead of setting each one
+var Profiles = map[string]func(j *Jim){
+	// quiet invites Jim without letting him cause trouble, e.g. so a
+	// scenario or the API can set his chances later
+	"quiet": func(j *Jim) {
+		*j = Jim{
+			AcceptChance:         1,
+			LinkSpeedMin:         j.LinkSpeedMin,
+			LinkSpeedMax:         j.LinkSpeedMax,
+			RejectSenderCodes:    j.RejectSenderCodes,
+			RejectRecipientCodes: j.RejectRecipientCodes,
+			RejectAuthCodes:      j.RejectAuthCodes,
+			RejectDataCodes:      j.RejectDataCodes,
+			RejectMessageCodes:   j.RejectMessageCodes,
+			DelayMessageMin:      j.DelayMessageMin,
+			DelayMessageMax:      j.DelayMessageMax,
+			Seed:                 j.Seed,
+		}
+	},
+	// flaky fails occasionally with temporary errors, which clients
+	// should retry
+	"flaky": func(j *Jim) {
+		j.DisconnectChance, j.AcceptChance, j.LinkSpeedAffect = 0.01, 0.95, 0
+		j.RejectSenderChance, j.RejectRecipientChance, j.RejectAuthChance = 0.05, 0.05, 0
+		j.RejectSenderCodes, j.RejectRecipientCodes = Codes{451}, Codes{450, 451, 452}
+		j.RejectMessageChance, j.RejectMessageCodes = 0.05, Codes{451, 452}
+	},
+	// hostile fails often, permanently and at every stage of a session
+	"hostile": func(j *Jim) {
+		j.DisconnectChance, j.AcceptChance, j.ShutdownChance = 0.05, 0.8, 0.02
+		j.RejectSenderChance, j.RejectRecipientChance, j.RejectAuthChance = 0.2, 0.2, 0.2
+		j.RejectSenderCodes, j.RejectRecipientCodes = Codes{421, 451, 550, 553}, Codes{450, 452, 550, 553}
+		j.RejectDataChance, j.RejectDataCodes = 0.1, Codes{451, 554}
+		j.RejectMessageChance, j.RejectMessageCodes = 0.1, Codes{451, 552, 554}
+		j.DiscardMessageChance, j.DuplicateMessageChance = 0.05, 0.05
+		j.TruncateReplyChance = 0.05
+	},
+	// slow throttles connections and delays replies, to exercise client
+	// timeouts
+	"slow": func(j *Jim) {
+		j.LinkSpeedAffect = 1
+		j.DelayMessageChance, j.DelayMessageMin, j.DelayMessageMax = 0.5, time.Second, 30*time.Second
+		j.ReplyDelays = Delays{"*": {Distribution: DelayUniform, Min: 0, Max: 5 * time.Second}}
+	},
+	// tls breaks STARTTLS and the extensions advertised with EHLO
+	"tls": func(j *Jim) {
+		j.DropExtensionsChance, j.GarbleExtensionsChance = 0.1, 0.1
+		j.RejectSTARTTLSChance = 0.2
+		j.ExpiredCertificateChance, j.MismatchedCertificateChance = 0.2, 0.2
+	},
+}
+
+// ProfileNames returns the names of the profiles, sorted
+func ProfileNames() []string {
+	var names []string
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EnvName returns the environment variable equivalent to a flag, e.g.
+// MH_JIM_ACCEPT for jim-accept
+func EnvName(flagName string) string {
+	return "MH_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// LoadSettings applies Jim's settings from a profile, a JSON file and the
+// environment. Each source overrides the one before it, and flags given on
+// the command line override them all:
+//
+//   - the named profile, if profile is set
+//   - the JSON file, if file is set, in the format used by the API
+//   - the environment variable named by EnvName for each flag in fs
+//     starting with prefix, e.g. MH_JIM_REJECT_SENDER_CODES
+//
+// Monkey settings added later get environment variables as long as their
+// flags start with prefix.
+func (j *Jim) LoadSettings(fs *flag.FlagSet, prefix, profile, file string) error {
+	// flags given on the command line are applied again at the end
+	given := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, prefix) {
+			given[f.Name] = f.Value.String()
+		}
+	})
+
+	if len(profile) > 0 {
+		p, ok := Profiles[profile]
+		if !ok {
+			return fmt.Errorf("unknown chaos profile %s, expected one of %s", profile, strings.Join(ProfileNames(), ", "))
+		}
+		p(j)
+	}
+
+	if len(file) > 0 {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, j); err != nil {
+			return fmt.Errorf("invalid Jim settings in %s: %s", file, err)
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || !strings.HasPrefix(f.Name, prefix) {
+			return
+		}
+		env := EnvName(f.Name)
+		if v, ok := os.LookupEnv(env); ok && len(v) > 0 {
+			if e := f.Value.Set(v); e != nil {
+				err = fmt.Errorf("invalid %s: %s", env, e)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, v := range given {
+		if err := fs.Set(name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
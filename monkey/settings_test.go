@@ -0,0 +1,76 @@
+package monkey
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLoadSettings(t *testing.T) {
+	newFlags := func(j *Jim) *flag.FlagSet {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Float64Var(&j.AcceptChance, "jim-accept", 0.99, "")
+		fs.Float64Var(&j.RejectSenderChance, "jim-reject-sender", 0.05, "")
+		fs.Float64Var(&j.RejectRecipientChance, "jim-reject-recipient", 0.05, "")
+		fs.Var(&j.RejectSenderCodes, "jim-reject-sender-codes", "")
+		fs.Var(&j.ReplyDelays, "jim-reply-delay", "")
+		return fs
+	}
+
+	Convey("EnvName should map flags to environment variables", t, func() {
+		So(EnvName("jim-reject-sender-codes"), ShouldEqual, "MH_JIM_REJECT_SENDER_CODES")
+	})
+
+	Convey("Settings should be overridden by the environment and then flags", t, func() {
+		dir, err := ioutil.TempDir("", "mailhog")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "jim.json")
+		So(ioutil.WriteFile(file, []byte(`{"RejectSenderChance": 0.3, "RejectRecipientChance": 0.4}`), 0600), ShouldBeNil)
+
+		os.Setenv("MH_JIM_REJECT_RECIPIENT", "0.5")
+		os.Setenv("MH_JIM_REJECT_SENDER_CODES", "451,452")
+		os.Setenv("MH_JIM_REPLY_DELAY", "RCPT=fixed:1s")
+		defer os.Unsetenv("MH_JIM_REJECT_RECIPIENT")
+		defer os.Unsetenv("MH_JIM_REJECT_SENDER_CODES")
+		defer os.Unsetenv("MH_JIM_REPLY_DELAY")
+
+		j := &Jim{}
+		fs := newFlags(j)
+		So(fs.Parse([]string{"-jim-reject-sender-codes", "421"}), ShouldBeNil)
+		So(j.LoadSettings(fs, "jim-", "hostile", file), ShouldBeNil)
+
+		// the profile's, then the file's, then the environment's, then flags
+		So(j.AcceptChance, ShouldEqual, 0.8)
+		So(j.RejectSenderChance, ShouldEqual, 0.3)
+		So(j.RejectRecipientChance, ShouldEqual, 0.5)
+		So(j.RejectSenderCodes, ShouldResemble, Codes{421})
+		So(j.ReplyDelays["RCPT"].String(), ShouldEqual, "fixed:1s")
+	})
+
+	Convey("Invalid settings should be rejected", t, func() {
+		j := &Jim{}
+		So(j.LoadSettings(newFlags(j), "jim-", "nope", ""), ShouldNotBeNil)
+
+		os.Setenv("MH_JIM_ACCEPT", "often")
+		defer os.Unsetenv("MH_JIM_ACCEPT")
+		So(j.LoadSettings(newFlags(j), "jim-", "", ""), ShouldNotBeNil)
+	})
+
+	Convey("Profiles should be valid", t, func() {
+		for _, name := range ProfileNames() {
+			j := &Jim{LinkSpeedMin: 1024, LinkSpeedMax: 10240, RejectSenderCodes: Codes{550}}
+			Profiles[name](j)
+			So(j.Validate(), ShouldBeNil)
+		}
+		j := &Jim{DisconnectChance: 0.5, Seed: 7}
+		Profiles["quiet"](j)
+		So(j.DisconnectChance, ShouldEqual, 0)
+		So(j.AcceptChance, ShouldEqual, 1)
+		So(j.Seed, ShouldEqual, 7)
+	})
+}
@@ -0,0 +1,375 @@
+package monkey
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ian-kent/linkio"
+	"github.com/mailhog/data"
+)
+
+// Stages recorded in Stats, in addition to the stages rules apply to.
+// StageSession is recorded for disconnects between commands, and
+// StageReply for truncated replies.
+const (
+	StageSession  = "session"
+	StageEHLO     = "ehlo"
+	StageSTARTTLS = "starttls"
+	StageTLS      = "tls"
+	StageReply    = "reply"
+)
+
+// Decision actions recorded in Stats, in addition to ActionAccept,
+// ActionReject and ActionDisconnect
+const (
+	ActionThrottle  = "throttle"
+	ActionDelay     = "delay"
+	ActionDiscard   = "discard"
+	ActionDuplicate = "duplicate"
+	ActionTruncate  = "truncate"
+)
+
+// Decision is a decision made by a chaos monkey
+type Decision struct {
+	Time   time.Time `json:"time"`
+	Stage  string    `json:"stage"`
+	Action string    `json:"action"`
+	// Subject is the remote address at the connect stage, or the sender or
+	// recipient the decision was about
+	Subject string `json:"subject,omitempty"`
+	Code    int    `json:"code,omitempty"`
+	// Detail describes throttles and delays
+	Detail string `json:"detail,omitempty"`
+}
+
+// StatsReport is a snapshot of Stats
+type StatsReport struct {
+	Since time.Time `json:"since"`
+	// Counts are the number of decisions made by stage and action
+	Counts map[string]map[string]uint64 `json:"counts"`
+	// Recent are the most recent decisions, oldest first
+	Recent []Decision `json:"recent"`
+}
+
+// Stats counts the decisions made by chaos monkeys, and keeps a log of
+// recent decisions
+type Stats struct {
+	mu     sync.Mutex
+	notify func(Decision)
+	since  time.Time
+	counts map[string]map[string]uint64
+	recent []Decision
+	limit  int
+}
+
+// NewStats returns Stats which keep the last limit decisions
+func NewStats(limit int) *Stats {
+	s := &Stats{limit: limit}
+	s.Reset()
+	return s
+}
+
+// Record counts a decision and adds it to the log
+func (s *Stats) Record(d Decision) {
+	if d.Time.IsZero() {
+		d.Time = time.Now()
+	}
+
+	s.mu.Lock()
+	if s.counts[d.Stage] == nil {
+		s.counts[d.Stage] = make(map[string]uint64)
+	}
+	s.counts[d.Stage][d.Action]++
+	if s.limit > 0 {
+		if len(s.recent) >= s.limit {
+			s.recent = append(s.recent[:0], s.recent[len(s.recent)-s.limit+1:]...)
+		}
+		s.recent = append(s.recent, d)
+	}
+	notify := s.notify
+	s.mu.Unlock()
+
+	if notify != nil {
+		notify(d)
+	}
+}
+
+// Notify sets a function called with each decision after it's recorded
+func (s *Stats) Notify(f func(Decision)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notify = f
+}
+
+// Report returns the counts and recent decisions since Stats were created
+// or last reset
+func (s *Stats) Report() *StatsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := &StatsReport{
+		Since:  s.since,
+		Counts: make(map[string]map[string]uint64),
+		Recent: append([]Decision{}, s.recent...),
+	}
+	for stage, actions := range s.counts {
+		r.Counts[stage] = make(map[string]uint64)
+		for action, n := range actions {
+			r.Counts[stage][action] = n
+		}
+	}
+	return r
+}
+
+// Reset clears the counts and decision log
+func (s *Stats) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.since = time.Now()
+	s.counts = make(map[string]map[string]uint64)
+	s.recent = nil
+}
+
+// Record returns a monkey which makes m's decisions, recording them in
+// stats. Only decisions which interfere with a session are recorded at
+// the reply delay and disconnect stages, which are consulted constantly.
+func Record(m ChaosMonkey, stats *Stats) ChaosMonkey {
+	if m == nil || stats == nil {
+		return m
+	}
+	return &recorder{m: m, stats: stats}
+}
+
+// recorder records the decisions of the monkey it wraps
+type recorder struct {
+	m     ChaosMonkey
+	stats *Stats
+}
+
+func (r *recorder) record(stage, action, subject string, reply *Reply) {
+	d := Decision{Stage: stage, Action: action, Subject: subject}
+	if reply != nil {
+		d.Code = reply.Code
+	}
+	r.stats.Record(d)
+}
+
+// replyAction returns the action a reply represents
+func replyAction(reply *Reply) string {
+	switch {
+	case reply == nil:
+		return ActionAccept
+	case reply.Disconnect:
+		return ActionDisconnect
+	default:
+		return ActionReject
+	}
+}
+
+func (r *recorder) RegisterFlags() {
+	r.m.RegisterFlags()
+}
+
+func (r *recorder) Configure(logf func(string, ...interface{})) {
+	r.m.Configure(logf)
+}
+
+func (r *recorder) ForSession() ChaosMonkey {
+	return &recorder{m: ForSession(r.m), stats: r.stats}
+}
+
+func (r *recorder) nextSession() uint64 {
+	return sessionIndex(r.m)
+}
+
+func (r *recorder) forSession(n uint64) ChaosMonkey {
+	return &recorder{m: sessionAt(r.m, n), stats: r.stats}
+}
+
+func (r *recorder) resume(remoteIP net.IP, sender string) {
+	if m, ok := r.m.(resumer); ok {
+		m.resume(remoteIP, sender)
+	}
+}
+
+func (r *recorder) ValidRCPT(rcpt string) bool {
+	return r.RCPTReply(rcpt) == nil
+}
+
+func (r *recorder) ValidMAIL(mail string) bool {
+	return r.MAILReply(mail) == nil
+}
+
+func (r *recorder) ValidAUTH(mechanism string, args ...string) bool {
+	return r.AUTHReply(mechanism, args...) == nil
+}
+
+func (r *recorder) Accept(conn net.Conn) bool {
+	var remote string
+	if conn != nil {
+		remote = conn.RemoteAddr().String()
+	}
+	ok := r.m.Accept(conn)
+	action := ActionAccept
+	if !ok {
+		action = ActionReject
+	}
+	r.record(StageConnect, action, remote, nil)
+	return ok
+}
+
+func (r *recorder) LinkSpeed() *linkio.Throughput {
+	t := r.m.LinkSpeed()
+	if t != nil {
+		r.stats.Record(Decision{Stage: StageConnect, Action: ActionThrottle, Detail: fmt.Sprintf("%.0f bytes per second", float64(*t/linkio.BytePerSecond))})
+	}
+	return t
+}
+
+func (r *recorder) Command(verb, args string) *Reply {
+	c, ok := r.m.(CommandMonkey)
+	if !ok {
+		return nil
+	}
+	reply := c.Command(verb, args)
+	if reply != nil {
+		stage := strings.ToLower(verb)
+		var subject string
+		switch stage {
+		case StageMAIL, StageRCPT:
+			subject = envelopeAddress(args)
+		}
+		r.record(stage, replyAction(reply), subject, reply)
+	}
+	return reply
+}
+
+func (r *recorder) MAILReply(mail string) *Reply {
+	reply := MAILReply(r.m, mail)
+	r.record(StageMAIL, replyAction(reply), mail, reply)
+	return reply
+}
+
+func (r *recorder) RCPTReply(rcpt string) *Reply {
+	reply := RCPTReply(r.m, rcpt)
+	r.record(StageRCPT, replyAction(reply), rcpt, reply)
+	return reply
+}
+
+func (r *recorder) AUTHReply(mechanism string, args ...string) *Reply {
+	reply := AUTHReply(r.m, mechanism, args...)
+	r.record(StageAUTH, replyAction(reply), "", reply)
+	return reply
+}
+
+func (r *recorder) DATAReply(from string, to []string) *Reply {
+	d, ok := r.m.(DataMonkey)
+	if !ok {
+		return nil
+	}
+	reply := d.DATAReply(from, to)
+	r.record(StageDATA, replyAction(reply), from, reply)
+	return reply
+}
+
+func (r *recorder) ReceivedMessage(msg *data.SMTPMessage) *Outcome {
+	d, ok := r.m.(DataMonkey)
+	if !ok {
+		return nil
+	}
+	o := d.ReceivedMessage(msg)
+
+	decision := Decision{Stage: StageMessage, Action: ActionAccept, Subject: msg.From}
+	if o != nil {
+		switch {
+		case o.Reply != nil:
+			decision.Action, decision.Code = replyAction(o.Reply), o.Reply.Code
+		case o.Discard:
+			decision.Action = ActionDiscard
+		case o.Copies > 0:
+			decision.Action = ActionDuplicate
+		case o.Delay > 0:
+			decision.Action = ActionDelay
+		}
+		if o.Delay > 0 {
+			decision.Detail = o.Delay.String()
+		}
+	}
+	r.stats.Record(decision)
+	return o
+}
+
+func (r *recorder) ReplyDelay(verb string) time.Duration {
+	d, ok := r.m.(DelayMonkey)
+	if !ok {
+		return 0
+	}
+	delay := d.ReplyDelay(verb)
+	if delay > 0 {
+		stage := strings.ToLower(verb)
+		if verb == VerbEOD {
+			stage = StageMessage
+		}
+		r.stats.Record(Decision{Stage: stage, Action: ActionDelay, Detail: delay.String()})
+	}
+	return delay
+}
+
+func (r *recorder) Disconnect() bool {
+	ok := r.m.Disconnect()
+	if ok {
+		r.stats.Record(Decision{Stage: StageSession, Action: ActionDisconnect})
+	}
+	return ok
+}
+
+// EHLOFault records the fault as the action, e.g. FaultGarbleExtensions
+func (r *recorder) EHLOFault() string {
+	p, ok := r.m.(ProtocolMonkey)
+	if !ok {
+		return ""
+	}
+	fault := p.EHLOFault()
+	if len(fault) > 0 {
+		r.stats.Record(Decision{Stage: StageEHLO, Action: fault})
+	}
+	return fault
+}
+
+func (r *recorder) STARTTLSReply() *Reply {
+	p, ok := r.m.(ProtocolMonkey)
+	if !ok {
+		return nil
+	}
+	reply := p.STARTTLSReply()
+	r.record(StageSTARTTLS, replyAction(reply), "", reply)
+	return reply
+}
+
+// CertificateFault records the fault as the action, e.g.
+// FaultExpiredCertificate
+func (r *recorder) CertificateFault() string {
+	p, ok := r.m.(ProtocolMonkey)
+	if !ok {
+		return ""
+	}
+	fault := p.CertificateFault()
+	if len(fault) > 0 {
+		r.stats.Record(Decision{Stage: StageTLS, Action: fault})
+	}
+	return fault
+}
+
+func (r *recorder) TruncateReply(verb string, lines int) int {
+	p, ok := r.m.(ProtocolMonkey)
+	if !ok {
+		return lines
+	}
+	n := p.TruncateReply(verb, lines)
+	if n < lines {
+		r.stats.Record(Decision{Stage: StageReply, Action: ActionTruncate, Subject: verb, Detail: fmt.Sprintf("%d of %d lines", n, lines)})
+	}
+	return n
+}
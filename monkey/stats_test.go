@@ -0,0 +1,53 @@
+package monkey
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStats(t *testing.T) {
+	Convey("Stats should count decisions and keep the most recent", t, func() {
+		s := NewStats(2)
+		var notified []Decision
+		s.Notify(func(d Decision) { notified = append(notified, d) })
+
+		s.Record(Decision{Stage: StageRCPT, Action: ActionReject, Subject: "a"})
+		s.Record(Decision{Stage: StageRCPT, Action: ActionReject, Subject: "b"})
+		s.Record(Decision{Stage: StageRCPT, Action: ActionAccept, Subject: "c"})
+
+		r := s.Report()
+		So(r.Counts[StageRCPT][ActionReject], ShouldEqual, 2)
+		So(r.Counts[StageRCPT][ActionAccept], ShouldEqual, 1)
+		So(r.Recent, ShouldHaveLength, 2)
+		So(r.Recent[0].Subject, ShouldEqual, "b")
+		So(r.Recent[1].Time.IsZero(), ShouldBeFalse)
+		So(notified, ShouldHaveLength, 3)
+
+		s.Reset()
+		r = s.Report()
+		So(r.Counts, ShouldBeEmpty)
+		So(r.Recent, ShouldBeEmpty)
+	})
+
+	Convey("Recorded monkeys should record each decision", t, func() {
+		j := newJim(1)
+		j.AcceptChance, j.RejectRecipientChance, j.DisconnectChance = 1, 1, 0
+		j.RejectRecipientCodes = Codes{452}
+		s := NewStats(10)
+		m := Record(j, s).(SessionMonkey).ForSession()
+
+		So(m.Accept(nil), ShouldBeTrue)
+		So(m.ValidMAIL("a@test"), ShouldBeTrue)
+		So(RCPTReply(m, "b@test").Code, ShouldEqual, 452)
+		So(m.Disconnect(), ShouldBeFalse)
+
+		r := s.Report()
+		So(r.Counts, ShouldResemble, map[string]map[string]uint64{
+			StageConnect: {ActionAccept: 1},
+			StageMAIL:    {ActionAccept: 1},
+			StageRCPT:    {ActionReject: 1},
+		})
+		So(r.Recent[2], ShouldResemble, Decision{Time: r.Recent[2].Time, Stage: StageRCPT, Action: ActionReject, Subject: "b@test", Code: 452})
+	})
+}
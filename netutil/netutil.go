@@ -0,0 +1,79 @@
+package netutil
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// UnixPrefix marks a bind address as the path of a unix domain socket
+const UnixPrefix = "unix:"
+
+// Listen listens on addr, which is either a TCP address such as
+// 0.0.0.0:1025, or unix:/path/to/socket for a unix domain socket
+//
+// A unix domain socket is created with the permissions in mode. If a
+// socket already exists at the path but nothing is listening on it, it's
+// assumed to be left over from an earlier run and is removed.
+func Listen(addr string, mode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(addr, UnixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, UnixPrefix)
+	if err := removeStale(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// removeStale removes the socket at path if nothing is listening on it
+func removeStale(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.New(path + " exists and is not a socket")
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return errors.New(path + " is in use")
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// RemoteAddr returns the address of the peer of conn
+//
+// Clients of unix domain sockets are usually unnamed, so they're
+// identified by the socket they connected to.
+func RemoteAddr(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	if addr.Network() != "unix" {
+		return addr.String()
+	}
+	if s := addr.String(); len(s) > 0 && s != "@" {
+		return UnixPrefix + s
+	}
+	return UnixPrefix + conn.LocalAddr().String()
+}
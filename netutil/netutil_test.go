@@ -0,0 +1,60 @@
+package netutil
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestListen(t *testing.T) {
+	Convey("Listen should create unix domain sockets", t, func() {
+		path := filepath.Join(t.TempDir(), "smtp.sock")
+
+		ln, err := Listen(UnixPrefix+path, 0600)
+		So(err, ShouldBeNil)
+		fi, err := os.Stat(path)
+		So(err, ShouldBeNil)
+		So(fi.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+
+		_, err = Listen(UnixPrefix+path, 0600)
+		So(err, ShouldNotBeNil)
+
+		accepted := make(chan string)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- RemoteAddr(conn)
+			conn.Close()
+		}()
+		conn, err := net.Dial("unix", path)
+		So(err, ShouldBeNil)
+		So(<-accepted, ShouldEqual, UnixPrefix+path)
+		conn.Close()
+		ln.Close()
+	})
+
+	Convey("Listen should replace stale sockets", t, func() {
+		path := filepath.Join(t.TempDir(), "api.sock")
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		So(err, ShouldBeNil)
+		l.SetUnlinkOnClose(false)
+		l.Close()
+
+		ln, err := Listen(UnixPrefix+path, 0660)
+		So(err, ShouldBeNil)
+		ln.Close()
+	})
+
+	Convey("Listen should refuse to replace other files", t, func() {
+		path := filepath.Join(t.TempDir(), "file")
+		So(os.WriteFile(path, nil, 0600), ShouldBeNil)
+		_, err := Listen(UnixPrefix+path, 0660)
+		So(err, ShouldNotBeNil)
+	})
+}
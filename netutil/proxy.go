@@ -0,0 +1,184 @@
+package netutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Trusted is a list of networks whose connections are expected to start
+// with a PROXY protocol header, e.g. load balancers
+type Trusted []*net.IPNet
+
+// ParseTrusted parses a comma separated list of IP addresses and CIDR
+// networks
+func ParseTrusted(s string) (Trusted, error) {
+	var trusted Trusted
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted address: %s", item)
+		}
+		trusted = append(trusted, n)
+	}
+	return trusted, nil
+}
+
+// Contains returns true if addr is a TCP address in a trusted network
+func (t Trusted) Contains(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range t {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection whose remote address was read from a PROXY
+// protocol header
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// ReadProxyHeader reads a PROXY protocol v1 or v2 header from conn, and
+// returns a connection reporting the client address from the header as
+// its remote address
+//
+// The header must arrive within timeout. Headers for LOCAL connections,
+// such as health checks, or unknown protocols leave the remote address
+// unchanged.
+func ReadProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	c := &proxyConn{Conn: conn, r: r, remote: conn.RemoteAddr()}
+
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	var remote net.Addr
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		remote, err = readProxyV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		remote, err = readProxyV1(r)
+	default:
+		return nil, errors.New("missing PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote != nil {
+		c.remote = remote
+	}
+	return c, nil
+}
+
+// readProxyV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 25\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// the longest v1 header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("invalid PROXY protocol v1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads a binary header, which is the signature followed by
+// version and command, address family, address length and addresses
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	verCmd, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, errors.New("invalid PROXY protocol version")
+	}
+	switch verCmd & 0xF {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errors.New("invalid PROXY protocol command")
+	}
+
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("invalid PROXY protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("invalid PROXY protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,82 @@
+package netutil
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// readProxy writes header and data to a pipe and reads them with
+// ReadProxyHeader
+func readProxy(header []byte) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(append(header, "EHLO localhost\r\n"...))
+		client.Close()
+	}()
+	return ReadProxyHeader(server, time.Second)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	Convey("ReadProxyHeader should read v1 headers", t, func() {
+		conn, err := readProxy([]byte("PROXY TCP4 192.0.2.10 192.0.2.1 56324 25\r\n"))
+		So(err, ShouldBeNil)
+		So(conn.RemoteAddr().String(), ShouldEqual, "192.0.2.10:56324")
+		b, _ := ioutil.ReadAll(conn)
+		So(string(b), ShouldEqual, "EHLO localhost\r\n")
+
+		conn, err = readProxy([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 1234 25\r\n"))
+		So(err, ShouldBeNil)
+		So(conn.RemoteAddr().String(), ShouldEqual, "[2001:db8::1]:1234")
+
+		conn, err = readProxy([]byte("PROXY UNKNOWN\r\n"))
+		So(err, ShouldBeNil)
+		So(conn.RemoteAddr().String(), ShouldEqual, "pipe")
+
+		_, err = readProxy([]byte("PROXY TCP4 nowhere 192.0.2.1 56324 25\r\n"))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("ReadProxyHeader should read v2 headers", t, func() {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x21, 0x11, 0, 12)
+		header = append(header, 192, 0, 2, 10, 192, 0, 2, 1)
+		header = binary.BigEndian.AppendUint16(header, 56324)
+		header = binary.BigEndian.AppendUint16(header, 25)
+
+		conn, err := readProxy(header)
+		So(err, ShouldBeNil)
+		So(conn.RemoteAddr().String(), ShouldEqual, "192.0.2.10:56324")
+		b, _ := ioutil.ReadAll(conn)
+		So(string(b), ShouldEqual, "EHLO localhost\r\n")
+
+		local := append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0, 0)
+		conn, err = readProxy(local)
+		So(err, ShouldBeNil)
+		So(conn.RemoteAddr().String(), ShouldEqual, "pipe")
+	})
+
+	Convey("ReadProxyHeader should reject connections without a header", t, func() {
+		_, err := readProxy(nil)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestTrusted(t *testing.T) {
+	Convey("Trusted should match addresses and networks", t, func() {
+		trusted, err := ParseTrusted("10.0.0.0/8, 192.0.2.1, ::1")
+		So(err, ShouldBeNil)
+		So(trusted.Contains(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}), ShouldBeTrue)
+		So(trusted.Contains(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}), ShouldBeTrue)
+		So(trusted.Contains(&net.TCPAddr{IP: net.ParseIP("192.0.2.2")}), ShouldBeFalse)
+		So(trusted.Contains(&net.TCPAddr{IP: net.ParseIP("::1")}), ShouldBeTrue)
+		So(trusted.Contains(&net.UnixAddr{Name: "/tmp/smtp.sock"}), ShouldBeFalse)
+
+		_, err = ParseTrusted("nowhere")
+		So(err, ShouldNotBeNil)
+	})
+}
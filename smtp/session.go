@@ -3,12 +3,24 @@ package smtp
 // http://www.rfc-editor.org/rfc/rfc5321.txt
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"strings"
+	"time"
 
 	"github.com/ian-kent/linkio"
+	"github.com/mailhog/MailHog-Server/bus"
+	"github.com/mailhog/MailHog-Server/logging"
+	"github.com/mailhog/MailHog-Server/metrics"
 	"github.com/mailhog/MailHog-Server/monkey"
+	"github.com/mailhog/MailHog-Server/tlsutil"
+	"github.com/mailhog/MailHog-Server/transcript"
 	"github.com/mailhog/data"
 	"github.com/mailhog/smtp"
 	"github.com/mailhog/storage"
@@ -16,24 +28,47 @@ import (
 
 // Session represents a SMTP session using net.TCPConn
 type Session struct {
+	id            string
 	conn          io.ReadWriteCloser
 	proto         *smtp.Protocol
 	storage       storage.Storage
-	messageChan   chan *data.Message
+	bus           *bus.Bus
 	remoteAddress string
 	isTLS         bool
+	tlsConfig     *tls.Config
 	line          string
 	link          *linkio.Link
 
-	reader io.Reader
-	writer io.Writer
-	monkey monkey.ChaosMonkey
+	reader    io.Reader
+	writer    io.Writer
+	monkey    monkey.ChaosMonkey
+	logger    *slog.Logger
+	dataBytes int
+
+	// verb is the command being replied to, used to choose reply delays.
+	// It's empty until the first command.
+	verb string
+	// args are the arguments of the command being parsed. The protocol
+	// doesn't always pass them to the verb filter, so they're taken from
+	// the line.
+	args string
+	// monkeyReply is sent in place of the reply to the current command,
+	// when a monkey rejects it
+	monkeyReply *monkey.Reply
+
+	recorder    *transcript.Recorder
+	transcripts *transcript.Store
 }
 
 // Accept starts a new SMTP session using io.ReadWriteCloser
-func Accept(remoteAddress string, conn io.ReadWriteCloser, storage storage.Storage, messageChan chan *data.Message, hostname string, monkey monkey.ChaosMonkey) {
+//
+// STARTTLS is offered if tlsConfig is set and conn is a net.Conn.
+func Accept(remoteAddress string, conn io.ReadWriteCloser, storage storage.Storage, bus *bus.Bus, hostname string, monkey monkey.ChaosMonkey, transcripts *transcript.Store, tlsConfig *tls.Config) {
 	defer conn.Close()
 
+	metrics.SessionsActive.Inc()
+	defer metrics.SessionsActive.Dec()
+
 	proto := smtp.NewProtocol()
 	proto.Hostname = hostname
 	var link *linkio.Link
@@ -48,31 +83,86 @@ func Accept(remoteAddress string, conn io.ReadWriteCloser, storage storage.Stora
 		}
 	}
 
-	session := &Session{conn, proto, storage, messageChan, remoteAddress, false, "", link, reader, writer, monkey}
+	id := newSessionID()
+	session := &Session{
+		id:            id,
+		conn:          conn,
+		proto:         proto,
+		storage:       storage,
+		bus:           bus,
+		remoteAddress: remoteAddress,
+		link:          link,
+		reader:        reader,
+		writer:        writer,
+		monkey:        monkey,
+		logger:        slog.With("session", id, "remote", remoteAddress),
+		recorder:      transcript.NewRecorder(id, remoteAddress),
+		transcripts:   transcripts,
+		tlsConfig:     tlsConfig,
+	}
 	proto.LogHandler = session.logf
 	proto.MessageReceivedHandler = session.acceptMessage
 	proto.ValidateSenderHandler = session.validateSender
 	proto.ValidateRecipientHandler = session.validateRecipient
 	proto.ValidateAuthenticationHandler = session.validateAuthentication
 	proto.GetAuthenticationMechanismsHandler = func() []string { return []string{"PLAIN"} }
+	proto.SMTPVerbFilter = session.verbFilter
+	if _, ok := conn.(net.Conn); ok && tlsConfig != nil {
+		proto.TLSHandler = session.startTLS
+	}
 
-	session.logf("Starting session")
+	session.logger.Info("Starting session")
 	session.Write(proto.Start())
 	for session.Read() == true {
-		if monkey != nil && monkey.Disconnect != nil && monkey.Disconnect() {
+		if monkey != nil && monkey.Disconnect() {
+			metrics.SessionsRejected.WithLabelValues("disconnect").Inc()
 			session.conn.Close()
 			break
 		}
 	}
-	session.logf("Session ended")
+	session.recorder.End()
+	if transcripts != nil {
+		transcripts.Finish(session.recorder)
+	}
+	session.logger.Info("Session ended")
 }
 
+// newSessionID returns a random identifier used to correlate log entries
+func newSessionID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// verbFilter lets a CommandMonkey reply to a command, or a DataMonkey
+// to the DATA command, before it's processed. The protocol only accepts
+// its own replies, so it's given a placeholder which Read replaces with
+// the monkey's reply. The command's arguments are the ones recorded by
+// setVerb, whether or not the protocol passes them.
+func (c *Session) verbFilter(verb string, _ ...string) *smtp.Reply {
+	var reply *monkey.Reply
+	if m, ok := c.monkey.(monkey.CommandMonkey); ok {
+		reply = m.Command(verb, c.args)
+	}
+	if m, ok := c.monkey.(monkey.DataMonkey); ok && reply == nil && strings.ToUpper(verb) == "DATA" {
+		reply = m.DATAReply(c.proto.Message.From, c.proto.Message.To)
+	}
+	if reply == nil {
+		return nil
+	}
+	metrics.CommandsRejected.WithLabelValues(strings.ToUpper(verb)).Inc()
+	c.monkeyReply = reply
+	return smtp.ReplyError(errors.New(reply.Text))
+}
+
+// validateAuthentication, validateRecipient and validateSender return
+// the protocol's own rejection, which Read replaces with the monkey's reply
 func (c *Session) validateAuthentication(mechanism string, args ...string) (errorReply *smtp.Reply, ok bool) {
 	if c.monkey != nil {
-		ok := c.monkey.ValidAUTH(mechanism, args...)
-		if !ok {
-			// FIXME better error?
-			return smtp.ReplyUnrecognisedCommand(), false
+		if r := monkey.AUTHReply(c.monkey, mechanism, args...); r != nil {
+			metrics.CommandsRejected.WithLabelValues("AUTH").Inc()
+			c.monkeyReply = r
+			return smtp.ReplyInvalidAuth(), false
 		}
 	}
 	return nil, true
@@ -80,8 +170,9 @@ func (c *Session) validateAuthentication(mechanism string, args ...string) (erro
 
 func (c *Session) validateRecipient(to string) bool {
 	if c.monkey != nil {
-		ok := c.monkey.ValidRCPT(to)
-		if !ok {
+		if r := monkey.RCPTReply(c.monkey, to); r != nil {
+			metrics.CommandsRejected.WithLabelValues("RCPT").Inc()
+			c.monkeyReply = r
 			return false
 		}
 	}
@@ -90,26 +181,254 @@ func (c *Session) validateRecipient(to string) bool {
 
 func (c *Session) validateSender(from string) bool {
 	if c.monkey != nil {
-		ok := c.monkey.ValidMAIL(from)
-		if !ok {
+		if r := monkey.MAILReply(c.monkey, from); r != nil {
+			metrics.CommandsRejected.WithLabelValues("MAIL").Inc()
+			c.monkeyReply = r
 			return false
 		}
 	}
 	return true
 }
 
+// startTLS starts TLS after the reply to STARTTLS is sent, unless a
+// ProtocolMonkey refuses it. The monkey can also choose a broken
+// certificate for the handshake.
+func (c *Session) startTLS(done func(ok bool)) (errorReply *smtp.Reply, callback func(), ok bool) {
+	cfg := c.tlsConfig
+	if m, ok := c.monkey.(monkey.ProtocolMonkey); ok {
+		if r := m.STARTTLSReply(); r != nil {
+			metrics.CommandsRejected.WithLabelValues("STARTTLS").Inc()
+			c.monkeyReply = r
+			return smtp.ReplyError(errors.New(r.Text)), nil, false
+		}
+		if fault := m.CertificateFault(); len(fault) > 0 {
+			cert, err := faultCertificate(fault, c.proto.Hostname)
+			if err != nil {
+				c.logger.Error("Error generating certificate", "fault", fault, "error", err)
+			} else {
+				c.logger.Info("Serving broken certificate", "fault", fault)
+				cfg = cfg.Clone()
+				cfg.Certificates = []tls.Certificate{cert}
+				cfg.GetCertificate = nil
+			}
+		}
+	}
+
+	return nil, func() {
+		conn := tls.Server(c.conn.(net.Conn), cfg)
+		if err := conn.Handshake(); err != nil {
+			c.logger.Warn("TLS handshake failed", "error", err)
+			done(false)
+			conn.Close()
+			return
+		}
+		c.logger.Info("Started TLS", "version", tls.VersionName(conn.ConnectionState().Version))
+		c.conn, c.reader, c.writer = conn, io.Reader(conn), io.Writer(conn)
+		if c.link != nil {
+			c.reader = c.link.NewLinkReader(io.Reader(conn))
+			c.writer = c.link.NewLinkWriter(io.Writer(conn))
+		}
+		// anything pipelined before the handshake is discarded, RFC 3207
+		c.line = ""
+		c.setTLS(true)
+		done(true)
+	}, true
+}
+
+// setTLS records whether the session is using TLS, including in its
+// transcript
+func (c *Session) setTLS(tls bool) {
+	c.isTLS = tls
+	c.recorder.SetTLS(tls)
+}
+
+// faultCertificate returns a self-signed certificate broken as fault
+// describes
+func faultCertificate(fault, hostname string) (tls.Certificate, error) {
+	now := time.Now()
+	switch fault {
+	case monkey.FaultExpiredCertificate:
+		return tlsutil.SelfSigned([]string{hostname}, now.AddDate(-1, 0, 0), now.Add(-time.Hour))
+	case monkey.FaultMismatchedCertificate:
+		return tlsutil.SelfSigned([]string{"mismatched.invalid"}, now.Add(-time.Hour), now.AddDate(1, 0, 0))
+	}
+	return tls.Certificate{}, fmt.Errorf("unknown certificate fault: %s", fault)
+}
+
+// ehloLines returns the lines of a reply to EHLO, with the extensions
+// dropped or garbled if a ProtocolMonkey decides to break them
+func (c *Session) ehloLines(lines []string) []string {
+	m, ok := c.monkey.(monkey.ProtocolMonkey)
+	if !ok || len(lines) < 2 {
+		return lines
+	}
+	switch m.EHLOFault() {
+	case monkey.FaultDropExtensions:
+		return []string{lines[0][:3] + " " + lines[0][4:]}
+	case monkey.FaultGarbleExtensions:
+		garbled := []string{lines[0]}
+		for _, l := range lines[1:] {
+			// the extension keywords are reversed, which keeps the reply
+			// well formed but unrecognisable
+			text := []rune(strings.TrimRight(l[4:], "\r\n"))
+			for i, j := 0, len(text)-1; i < j; i, j = i+1, j-1 {
+				text[i], text[j] = text[j], text[i]
+			}
+			garbled = append(garbled, l[:4]+string(text)+"\r\n")
+		}
+		return garbled
+	}
+	return lines
+}
+
+// acceptMessage stores a received message, unless a DataMonkey decides
+// to delay, reject, discard or duplicate it
 func (c *Session) acceptMessage(msg *data.SMTPMessage) (id string, err error) {
+	var o *monkey.Outcome
+	if m, ok := c.monkey.(monkey.DataMonkey); ok {
+		o = m.ReceivedMessage(msg)
+	}
+	if o == nil {
+		return c.storeMessage(msg)
+	}
+
+	if o.Delay > 0 {
+		c.logger.Info("Delaying acknowledgement", "delay", o.Delay)
+		time.Sleep(o.Delay)
+	}
+	if o.Reply != nil {
+		metrics.CommandsRejected.WithLabelValues("DATA").Inc()
+		c.monkeyReply = o.Reply
+		return "", errors.New(o.Reply.Text)
+	}
+	if o.Discard {
+		m := msg.Parse(c.proto.Hostname)
+		c.logger.Info("Discarding message", "id", m.ID, "size", len(msg.Data))
+		return string(m.ID), nil
+	}
+
+	id, err = c.storeMessage(msg)
+	for i := 0; err == nil && i < o.Copies; i++ {
+		c.logger.Info("Storing duplicate message", "of", id)
+		c.storeMessage(msg)
+	}
+	return id, err
+}
+
+func (c *Session) storeMessage(msg *data.SMTPMessage) (id string, err error) {
 	m := msg.Parse(c.proto.Hostname)
-	c.logf("Storing message %s", m.ID)
+	m.Content.Headers["Received"] = []string{c.receivedHeader(msg.Helo, m.ID)}
+	c.logger.Info("Storing message", "id", m.ID, "size", len(msg.Data))
+	t := metrics.TimeStorage("store")
 	id, err = c.storage.Store(m)
-	c.messageChan <- m
+	t.ObserveDuration()
+	if err == nil {
+		metrics.MessagesStored.Inc()
+		c.recorder.Delivered(string(m.ID))
+		if c.transcripts != nil {
+			c.transcripts.Attach(string(m.ID), c.recorder)
+		}
+		if c.bus != nil {
+			c.bus.Publish(m)
+		}
+	}
 	return
 }
 
+// receivedHeader returns the Received header for a message, which unlike
+// the one added by data.SMTPMessage.Parse includes the client's address
+func (c *Session) receivedHeader(helo string, id data.MessageID) string {
+	from := c.remoteAddress
+	if host, _, err := net.SplitHostPort(from); err == nil {
+		from = "[" + host + "]"
+	}
+	return fmt.Sprintf("from %s (%s) by %s (MailHog)\r\n          id %s; %s", helo, from, c.proto.Hostname, id, time.Now().Format(time.RFC1123Z))
+}
+
 func (c *Session) logf(message string, args ...interface{}) {
-	message = strings.Join([]string{"[SMTP %s]", message}, " ")
-	args = append([]interface{}{c.remoteAddress}, args...)
-	log.Printf(message, args...)
+	if logging.Redact && c.isSensitive(message, args...) {
+		redacted := make([]interface{}, len(args))
+		for i := range redacted {
+			redacted[i] = "<redacted>"
+		}
+		args = redacted
+	}
+	c.logger.Debug(strings.TrimSpace(fmt.Sprintf(message, args...)))
+}
+
+// isSensitive returns true if a protocol log entry may include
+// credentials or message data
+func (c *Session) isSensitive(message string, args ...interface{}) bool {
+	if c.proto != nil {
+		switch c.proto.State {
+		case smtp.AUTHPLAIN, smtp.AUTHLOGIN, smtp.AUTHLOGIN2, smtp.AUTHCRAMMD5, smtp.DATA:
+			return true
+		}
+	}
+	if strings.Contains(strings.ToLower(message), "auth") {
+		return true
+	}
+	for _, arg := range args {
+		if s, ok := arg.(string); ok && strings.HasPrefix(strings.ToUpper(s), "AUTH") {
+			return true
+		}
+	}
+	return false
+}
+
+// received logs and records a line received from the client
+//
+// Message data is recorded as a byte count, and AUTH credentials are
+// hidden unless redaction is disabled.
+func (c *Session) received(line string) {
+	if c.proto.State == smtp.DATA {
+		if line != "." {
+			c.dataBytes += len(line) + 2
+			if logging.Transcript && !logging.Redact {
+				c.logger.Info("Received", "line", line)
+			}
+			return
+		}
+		c.recorder.Data(c.dataBytes)
+		if logging.Transcript && logging.Redact {
+			c.logger.Info("Received", "data", fmt.Sprintf("<%d bytes redacted>", c.dataBytes))
+		}
+		c.dataBytes = 0
+	}
+
+	if logging.Redact {
+		switch c.proto.State {
+		case smtp.AUTHPLAIN, smtp.AUTHLOGIN, smtp.AUTHLOGIN2, smtp.AUTHCRAMMD5:
+			line = "<redacted>"
+		default:
+			if f := strings.Fields(line); len(f) > 2 && strings.ToUpper(f[0]) == "AUTH" {
+				line = f[0] + " " + f[1] + " <redacted>"
+			}
+		}
+	}
+
+	c.recorder.Received(line)
+	if logging.Transcript {
+		c.logger.Info("Received", "line", line)
+	}
+}
+
+// setVerb records the command a line starts and its arguments, before
+// it's parsed. Message data and authentication responses continue the
+// previous command.
+func (c *Session) setVerb(line string) {
+	switch c.proto.State {
+	case smtp.DATA:
+		if line == "." {
+			c.verb = monkey.VerbEOD
+		}
+	case smtp.AUTHPLAIN, smtp.AUTHLOGIN, smtp.AUTHLOGIN2, smtp.AUTHCRAMMD5:
+	default:
+		if f := strings.Fields(line); len(f) > 0 {
+			c.verb = strings.ToUpper(f[0])
+			c.args = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), f[0]))
+		}
+	}
 }
 
 // Read reads from the underlying net.TCPConn
@@ -118,29 +437,47 @@ func (c *Session) Read() bool {
 	n, err := c.reader.Read(buf)
 
 	if n == 0 {
-		c.logf("Connection closed by remote host\n")
+		c.logger.Info("Connection closed by remote host")
 		io.Closer(c.conn).Close() // not sure this is necessary?
 		return false
 	}
 
 	if err != nil {
-		c.logf("Error reading from socket: %s\n", err)
+		c.logger.Error("Error reading from socket", "error", err)
 		return false
 	}
 
-	text := string(buf[0:n])
-	logText := strings.Replace(text, "\n", "\\n", -1)
-	logText = strings.Replace(logText, "\r", "\\r", -1)
-	c.logf("Received %d bytes: '%s'\n", n, logText)
+	metrics.BytesReceived.Add(float64(n))
 
-	c.line += text
+	c.line += string(buf[0:n])
+	c.recorder.Read()
 
 	for strings.Contains(c.line, "\r\n") {
+		c.received(c.line[:strings.Index(c.line, "\r\n")])
+		c.setVerb(c.line[:strings.Index(c.line, "\r\n")])
 		line, reply := c.proto.Parse(c.line)
 		c.line = line
 
+		if r := c.monkeyReply; r != nil {
+			c.monkeyReply = nil
+			c.writeLines(r.Lines())
+			if r.Disconnect {
+				metrics.SessionsRejected.WithLabelValues("disconnect").Inc()
+				io.Closer(c.conn).Close()
+				return false
+			}
+			continue
+		}
+
 		if reply != nil {
-			c.Write(reply)
+			if c.verb == "EHLO" && reply.Status == 250 {
+				c.writeLines(c.ehloLines(reply.Lines()))
+			} else {
+				c.Write(reply)
+			}
+			if reply.Done != nil {
+				reply.Done()
+			}
 			if reply.Status == 221 {
 				io.Closer(c.conn).Close()
 				return false
@@ -153,11 +490,32 @@ func (c *Session) Read() bool {
 
 // Write writes a reply to the underlying net.TCPConn
 func (c *Session) Write(reply *smtp.Reply) {
-	lines := reply.Lines()
+	c.writeLines(reply.Lines())
+}
+
+func (c *Session) writeLines(lines []string) {
+	verb := c.verb
+	if len(verb) == 0 {
+		verb = monkey.VerbConnect
+	}
+	if m, ok := c.monkey.(monkey.DelayMonkey); ok && len(lines) > 0 {
+		if d := m.ReplyDelay(verb); d > 0 {
+			c.logger.Info("Delaying reply", "command", verb, "delay", d)
+			c.recorder.Delayed(d)
+			time.Sleep(d)
+		}
+	}
+	if m, ok := c.monkey.(monkey.ProtocolMonkey); ok && len(lines) > 1 {
+		if n := m.TruncateReply(verb, len(lines)); n < len(lines) {
+			c.logger.Info("Truncating reply", "command", verb, "lines", n, "of", len(lines))
+			lines = lines[:n]
+		}
+	}
 	for _, l := range lines {
-		logText := strings.Replace(l, "\n", "\\n", -1)
-		logText = strings.Replace(logText, "\r", "\\r", -1)
-		c.logf("Sent %d bytes: '%s'", len(l), logText)
+		c.recorder.Sent(strings.TrimRight(l, "\r\n"))
+		if logging.Transcript {
+			c.logger.Info("Sent", "line", strings.TrimRight(l, "\r\n"))
+		}
 		c.writer.Write([]byte(l))
 	}
 }
@@ -1,13 +1,21 @@
 package smtp
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
-	"sync"
+	"net"
+	gosmtp "net/smtp"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 
-	"github.com/mailhog/data"
+	"github.com/mailhog/MailHog-Server/bus"
+	"github.com/mailhog/MailHog-Server/monkey"
+	"github.com/mailhog/MailHog-Server/tlsutil"
+	"github.com/mailhog/MailHog-Server/transcript"
+	"github.com/mailhog/smtp"
 	"github.com/mailhog/storage"
 )
 
@@ -39,8 +47,7 @@ func (rw *fakeRw) Write(p []byte) (n int, err error) {
 func TestAccept(t *testing.T) {
 	Convey("Accept should handle a connection", t, func() {
 		frw := &fakeRw{}
-		mChan := make(chan *data.Message)
-		Accept("1.1.1.1:11111", frw, storage.CreateInMemory(), mChan, "localhost", nil)
+		Accept("1.1.1.1:11111", frw, storage.CreateInMemory(), bus.New(), "localhost", nil, nil, nil)
 	})
 }
 
@@ -51,14 +58,13 @@ func TestSocketError(t *testing.T) {
 				return -1, errors.New("OINK")
 			},
 		}
-		mChan := make(chan *data.Message)
-		Accept("1.1.1.1:11111", frw, storage.CreateInMemory(), mChan, "localhost", nil)
+		Accept("1.1.1.1:11111", frw, storage.CreateInMemory(), bus.New(), "localhost", nil, nil, nil)
 	})
 }
 
 func TestAcceptMessage(t *testing.T) {
 	Convey("acceptMessage should be called", t, func() {
-		mbuf := "EHLO localhost\nMAIL FROM:<test>\nRCPT TO:<test>\nDATA\nHi.\r\n.\r\nQUIT\n"
+		mbuf := "EHLO localhost\r\nMAIL FROM:<test>\r\nRCPT TO:<test>\r\nDATA\r\nHi.\r\n.\r\nQUIT\r\n"
 		var rbuf []byte
 		frw := &fakeRw{
 			_read: func(p []byte) (n int, err error) {
@@ -86,21 +92,14 @@ func TestAcceptMessage(t *testing.T) {
 				return nil
 			},
 		}
-		mChan := make(chan *data.Message)
-		var wg sync.WaitGroup
-		wg.Add(1)
-		handlerCalled := false
-		go func() {
-			handlerCalled = true
-			<-mChan
-			//FIXME breaks some tests (in drone.io)
-			//m := <-mChan
-			//So(m, ShouldNotBeNil)
-			wg.Done()
-		}()
-		Accept("1.1.1.1:11111", frw, storage.CreateInMemory(), mChan, "localhost", nil)
-		wg.Wait()
-		So(handlerCalled, ShouldBeTrue)
+		b := bus.New()
+		sub := b.Subscribe("test", 1)
+		Accept("1.1.1.1:11111", frw, storage.CreateInMemory(), b, "localhost", nil, nil, nil)
+		So(sub.C, ShouldHaveLength, 1)
+		So(sub.Dropped(), ShouldEqual, 0)
+
+		m := <-sub.C
+		So(m.Content.Headers["Received"][0], ShouldStartWith, "from localhost ([1.1.1.1]) by localhost (MailHog)")
 	})
 }
 
@@ -139,3 +138,259 @@ func TestValidateSender(t *testing.T) {
 		So(c.validateSender("foo@bar.mailhog"), ShouldBeTrue)
 	})
 }
+
+func TestIsSensitive(t *testing.T) {
+	Convey("isSensitive should detect credentials and message data", t, func() {
+		c := &Session{proto: smtp.NewProtocol()}
+
+		So(c.isSensitive("Processing line: %s", "MAIL FROM:<test>"), ShouldBeFalse)
+		So(c.isSensitive("Processing line: %s", "AUTH PLAIN AGZvbwBiYXI="), ShouldBeTrue)
+		So(c.isSensitive("Got PLAIN authentication response: '%s'", "AGZvbwBiYXI="), ShouldBeTrue)
+
+		c.proto.State = smtp.AUTHLOGIN
+		So(c.isSensitive("Processing line: %s", "Zm9v"), ShouldBeTrue)
+
+		c.proto.State = smtp.DATA
+		So(c.isSensitive("Processing line: %s", "Hi."), ShouldBeTrue)
+	})
+}
+
+// scriptedRw returns a fakeRw which reads in and appends writes to out
+func scriptedRw(in string, out *[]byte) *fakeRw {
+	return &fakeRw{
+		_read: func(p []byte) (n int, err error) {
+			n = copy(p, in)
+			in = in[n:]
+			return n, nil
+		},
+		_write: func(p []byte) (n int, err error) {
+			*out = append(*out, p...)
+			return len(p), nil
+		},
+	}
+}
+
+func TestMonkeyReply(t *testing.T) {
+	Convey("Replies from a CommandMonkey should replace the server's", t, func() {
+		rules := monkey.NewRuleSet()
+		So(rules.Set([]*monkey.Rule{
+			{ID: "bounce", Stage: monkey.StageRCPT, Address: "bounce@*", Action: monkey.ActionReject, Code: 550, Text: "No such user"},
+			{ID: "billing", Stage: monkey.StageDATA, Address: "*@billing", Action: monkey.ActionDisconnect},
+		}), ShouldBeNil)
+
+		var out []byte
+		in := "EHLO localhost\r\nMAIL FROM:<a@test>\r\nRCPT TO:<bounce@test>\r\nRCPT TO:<b@test>\r\nQUIT\r\n"
+		Accept("1.1.1.1:11111", scriptedRw(in, &out), storage.CreateInMemory(), bus.New(), "localhost", &monkey.Rules{Set: rules}, nil, nil)
+		So(string(out), ShouldContainSubstring, "550 No such user\r\n")
+		So(string(out), ShouldContainSubstring, "250 Recipient <b@test> ok\r\n")
+
+		out = nil
+		in = "EHLO localhost\r\nMAIL FROM:<a@billing>\r\nRCPT TO:<b@test>\r\nDATA\r\nHi.\r\n.\r\nQUIT\r\n"
+		Accept("1.1.1.1:11111", scriptedRw(in, &out), storage.CreateInMemory(), bus.New(), "localhost", &monkey.Rules{Set: rules}, nil, nil)
+		So(string(out), ShouldNotContainSubstring, "354")
+		So(string(out), ShouldNotContainSubstring, "221")
+	})
+}
+
+func TestMonkeyAcceptRule(t *testing.T) {
+	Convey("Accept rules should skip the fallback", t, func() {
+		rules := monkey.NewRuleSet()
+		So(rules.Set([]*monkey.Rule{
+			{ID: "tempfail", Stage: monkey.StageMAIL, Address: "slow@*", Action: monkey.ActionReject, Code: 451, Times: 2},
+			{ID: "sender", Stage: monkey.StageMAIL, Address: "slow@*", Action: monkey.ActionAccept},
+			{ID: "recipient", Stage: monkey.StageRCPT, Action: monkey.ActionAccept},
+			{ID: "data", Stage: monkey.StageDATA, Action: monkey.ActionAccept},
+		}), ShouldBeNil)
+		j := &monkey.Jim{AcceptChance: 1, RejectSenderChance: 1, RejectRecipientChance: 1, RejectDataChance: 1}
+		j.Configure(func(string, ...interface{}) {})
+
+		send := func() string {
+			var out []byte
+			in := "EHLO localhost\r\nMAIL FROM:<slow@test>\r\nRCPT TO:<b@test>\r\nDATA\r\nHi.\r\n.\r\nQUIT\r\n"
+			Accept("1.1.1.1:11111", scriptedRw(in, &out), storage.CreateInMemory(), bus.New(), "localhost", &monkey.Rules{Set: rules, Fallback: j.ForSession()}, nil, nil)
+			return string(out)
+		}
+		So(send(), ShouldContainSubstring, "451 ")
+		So(send(), ShouldContainSubstring, "451 ")
+
+		out := send()
+		So(out, ShouldContainSubstring, "250 Sender <slow@test> ok\r\n")
+		So(out, ShouldContainSubstring, "250 Recipient <b@test> ok\r\n")
+		So(out, ShouldContainSubstring, "354 ")
+		So(out, ShouldContainSubstring, "250 Ok: queued as ")
+	})
+}
+
+func TestMonkeyRejection(t *testing.T) {
+	Convey("Rejections should use the monkey's reply", t, func() {
+		j := &monkey.Jim{RejectSenderChance: 1, RejectSenderCodes: monkey.Codes{421}, RejectAuthChance: 1, AcceptChance: 1}
+		j.Configure(func(string, ...interface{}) {})
+
+		var out []byte
+		in := "EHLO localhost\r\nAUTH PLAIN AGZvbwBiYXI=\r\nMAIL FROM:<a@test>\r\nRCPT TO:<b@test>\r\nQUIT\r\n"
+		Accept("1.1.1.1:11111", scriptedRw(in, &out), storage.CreateInMemory(), bus.New(), "localhost", j.ForSession(), nil, nil)
+		So(string(out), ShouldContainSubstring, "535 5.7.8 Authentication credentials invalid\r\n")
+		So(string(out), ShouldEndWith, "421 4.3.2 Service not available, closing transmission channel\r\n")
+	})
+}
+
+func TestMonkeyMessage(t *testing.T) {
+	in := "EHLO localhost\r\nMAIL FROM:<a@test>\r\nRCPT TO:<b@test>\r\nDATA\r\nHi.\r\n.\r\nQUIT\r\n"
+	send := func(j *monkey.Jim) (string, *bus.Subscriber) {
+		j.AcceptChance = 1
+		j.Configure(func(string, ...interface{}) {})
+		var out []byte
+		b := bus.New()
+		sub := b.Subscribe("test", 10)
+		Accept("1.1.1.1:11111", scriptedRw(in, &out), storage.CreateInMemory(), b, "localhost", j.ForSession(), nil, nil)
+		return string(out), sub
+	}
+
+	Convey("A monkey should be able to reject a message after its final dot", t, func() {
+		out, sub := send(&monkey.Jim{RejectMessageChance: 1, RejectMessageCodes: monkey.Codes{452}})
+		So(out, ShouldContainSubstring, "354")
+		So(out, ShouldContainSubstring, "452 4.3.1 ")
+		So(sub.C, ShouldBeEmpty)
+	})
+
+	Convey("A monkey should be able to reject the DATA command", t, func() {
+		out, sub := send(&monkey.Jim{RejectDataChance: 1, RejectDataCodes: monkey.Codes{451}})
+		So(out, ShouldContainSubstring, "451 4.3.0 ")
+		So(out, ShouldNotContainSubstring, "354")
+		So(sub.C, ShouldBeEmpty)
+	})
+
+	Convey("A monkey should be able to discard or duplicate a message", t, func() {
+		out, sub := send(&monkey.Jim{DiscardMessageChance: 1})
+		So(out, ShouldContainSubstring, "250 Ok: queued as ")
+		So(sub.C, ShouldBeEmpty)
+
+		_, sub = send(&monkey.Jim{DuplicateMessageChance: 1})
+		So(sub.C, ShouldHaveLength, 2)
+	})
+}
+
+func TestMonkeyDelay(t *testing.T) {
+	Convey("Reply delays should be recorded in the transcript", t, func() {
+		j := &monkey.Jim{AcceptChance: 1, ReplyDelays: monkey.Delays{"RCPT": {Distribution: monkey.DelayFixed, Min: 10 * time.Millisecond}}}
+		j.Configure(func(string, ...interface{}) {})
+
+		var out []byte
+		transcripts := transcript.NewStore(10, 10)
+		in := "EHLO localhost\r\nMAIL FROM:<a@test>\r\nRCPT TO:<b@test>\r\nQUIT\r\n"
+		Accept("1.1.1.1:11111", scriptedRw(in, &out), storage.CreateInMemory(), bus.New(), "localhost", j.ForSession(), transcripts, nil)
+
+		var delayed []transcript.Entry
+		for _, e := range transcripts.Sessions()[0].Entries {
+			if e.Delay > 0 {
+				delayed = append(delayed, e)
+			}
+		}
+		So(delayed, ShouldHaveLength, 1)
+		So(delayed[0].Line, ShouldEqual, "250 Recipient <b@test> ok")
+		So(delayed[0].Delay, ShouldEqual, 10*time.Millisecond)
+	})
+}
+
+func TestMonkeyProtocol(t *testing.T) {
+	send := func(j *monkey.Jim, in string) string {
+		j.AcceptChance = 1
+		j.Configure(func(string, ...interface{}) {})
+		var out []byte
+		Accept("1.1.1.1:11111", scriptedRw(in, &out), storage.CreateInMemory(), bus.New(), "localhost", j.ForSession(), nil, nil)
+		return string(out)
+	}
+
+	Convey("A monkey should be able to drop or garble EHLO extensions", t, func() {
+		out := send(&monkey.Jim{DropExtensionsChance: 1}, "EHLO test\r\nQUIT\r\n")
+		So(out, ShouldContainSubstring, "250 Hello test\r\n")
+		So(out, ShouldNotContainSubstring, "PIPELINING")
+
+		out = send(&monkey.Jim{GarbleExtensionsChance: 1}, "EHLO test\r\nQUIT\r\n")
+		So(out, ShouldContainSubstring, "250-Hello test\r\n250-GNINILEPIP\r\n")
+		So(out, ShouldNotContainSubstring, "PIPELINING")
+	})
+
+	Convey("A monkey should be able to truncate multiline replies", t, func() {
+		out := send(&monkey.Jim{TruncateReplyChance: 1}, "EHLO test\r\nQUIT\r\n")
+		So(out, ShouldContainSubstring, "250-Hello test\r\n")
+		So(out, ShouldNotContainSubstring, "250 AUTH PLAIN\r\n")
+		So(out, ShouldContainSubstring, "221")
+	})
+
+	Convey("A monkey should be able to shut down in the middle of a session", t, func() {
+		out := send(&monkey.Jim{ShutdownChance: 1}, "HELO test\r\nMAIL FROM:<a@test>\r\nQUIT\r\n")
+		So(out, ShouldEndWith, "421 4.3.2 Service not available, closing transmission channel\r\n")
+		So(out, ShouldNotContainSubstring, "Hello test")
+	})
+}
+
+func TestSTARTTLS(t *testing.T) {
+	cfg, err := tlsutil.ServerConfig("", "", true, []string{"localhost"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// startTLS starts TLS with a session using j, returning the
+	// certificate served and the session's transcript
+	startTLS := func(j *monkey.Jim) (*x509.Certificate, transcript.Transcript, error) {
+		j.AcceptChance = 1
+		j.Configure(func(string, ...interface{}) {})
+		transcripts := transcript.NewStore(10, 10)
+		server, client := net.Pipe()
+		ended := make(chan struct{})
+		go func() {
+			Accept("1.1.1.1:11111", server, storage.CreateInMemory(), bus.New(), "localhost", j.ForSession(), transcripts, cfg)
+			close(ended)
+		}()
+
+		var cert *x509.Certificate
+		c, err := gosmtp.NewClient(client, "localhost")
+		if err == nil {
+			if ok, _ := c.Extension("STARTTLS"); !ok {
+				err = errors.New("STARTTLS not offered")
+			}
+		}
+		if err == nil {
+			err = c.StartTLS(&tls.Config{
+				InsecureSkipVerify: true,
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					cert = cs.PeerCertificates[0]
+					return nil
+				},
+			})
+		}
+		if err == nil {
+			err = c.Noop()
+		}
+		client.Close()
+		<-ended
+		return cert, transcripts.Sessions()[0], err
+	}
+
+	Convey("STARTTLS should upgrade the connection", t, func() {
+		cert, tr, err := startTLS(&monkey.Jim{})
+		So(err, ShouldBeNil)
+		So(cert.VerifyHostname("localhost"), ShouldBeNil)
+		So(cert.NotAfter.After(time.Now()), ShouldBeTrue)
+		So(tr.TLS, ShouldBeTrue)
+	})
+
+	Convey("A monkey should be able to refuse STARTTLS", t, func() {
+		_, tr, err := startTLS(&monkey.Jim{RejectSTARTTLSChance: 1})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "454")
+		So(err.Error(), ShouldContainSubstring, "TLS not available")
+		So(tr.TLS, ShouldBeFalse)
+	})
+
+	Convey("A monkey should be able to serve broken certificates", t, func() {
+		cert, _, err := startTLS(&monkey.Jim{ExpiredCertificateChance: 1})
+		So(err, ShouldBeNil)
+		So(cert.NotAfter.Before(time.Now()), ShouldBeTrue)
+
+		cert, _, err = startTLS(&monkey.Jim{MismatchedCertificateChance: 1})
+		So(err, ShouldBeNil)
+		So(cert.VerifyHostname("localhost"), ShouldNotBeNil)
+	})
+}
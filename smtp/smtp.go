@@ -2,42 +2,107 @@ package smtp
 
 import (
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"os"
+	"time"
 
 	"github.com/mailhog/MailHog-Server/config"
+	"github.com/mailhog/MailHog-Server/health"
+	"github.com/mailhog/MailHog-Server/metrics"
+	"github.com/mailhog/MailHog-Server/monkey"
+	"github.com/mailhog/MailHog-Server/netutil"
 )
 
-func Listen(cfg *config.Config, exitCh chan int) *net.TCPListener {
-	log.Printf("[SMTP] Binding to address: %s\n", cfg.SMTPBindAddr)
-	ln, err := net.Listen("tcp", cfg.SMTPBindAddr)
+// proxyHeaderTimeout is how long trusted upstreams have to send a PROXY
+// protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// listening is set once the SMTP listener is bound
+var listening = health.NewFlag("listener not bound")
+
+func init() {
+	health.Register("smtp", listening.Check)
+}
+
+func Listen(cfg *config.Config, exitCh chan int) net.Listener {
+	slog.Info("[SMTP] Binding to address", "addr", cfg.SMTPBindAddr)
+	ln, err := netutil.Listen(cfg.SMTPBindAddr, cfg.SocketMode)
 	if err != nil {
-		log.Fatalf("[SMTP] Error listening on socket: %s\n", err)
+		slog.Error("[SMTP] Error listening on socket", "error", err)
+		os.Exit(1)
 	}
 	defer ln.Close()
 
+	listening.Set(true)
+	defer listening.Set(false)
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("[SMTP] Error accepting connection: %s\n", err)
+			slog.Error("[SMTP] Error accepting connection", "error", err)
 			continue
 		}
+		// the monkey is chosen here so sessions get the same decisions
+		// for the same seed whatever order their goroutines run in
+		go handle(cfg, conn, cfg.Monkey.Session(func(v *monkey.Version) monkey.ChaosMonkey {
+			return chaosMonkey(cfg, v)
+		}))
+	}
+}
 
-		if cfg.Monkey != nil {
-			ok := cfg.Monkey.Accept(conn)
-			if !ok {
-				conn.Close()
-				continue
+// chaosMonkey returns the monkey for connections using version v of the
+// monkey config, which applies any chaos rules before falling back to
+// Jim, and records its decisions. The active scenario phase can replace
+// Jim, the rules or both.
+func chaosMonkey(cfg *config.Config, v *monkey.Version) monkey.ChaosMonkey {
+	m, rules := v.Monkey(), cfg.Rules
+	if cfg.Scenario != nil {
+		if p := cfg.Scenario.Current(); p != nil {
+			if pm := p.Monkey(); pm != nil {
+				m = pm
+			}
+			if pr := p.RuleSet(); pr != nil {
+				rules = pr
 			}
 		}
+	}
+	if rules != nil && rules.Len() > 0 {
+		m = &monkey.Rules{Set: rules, Fallback: m}
+	}
+	return monkey.Record(m, cfg.MonkeyStats)
+}
+
+func handle(cfg *config.Config, conn net.Conn, m monkey.ChaosMonkey) {
+	if cfg.SMTPProxyTrusted.Contains(conn.RemoteAddr()) {
+		c, err := netutil.ReadProxyHeader(conn, proxyHeaderTimeout)
+		if err != nil {
+			slog.Warn("[SMTP] Error reading PROXY protocol header", "remote", conn.RemoteAddr().String(), "error", err)
+			metrics.SessionsRejected.WithLabelValues("proxy").Inc()
+			conn.Close()
+			return
+		}
+		conn = c
+	}
 
-		go Accept(
-			conn.(*net.TCPConn).RemoteAddr().String(),
-			io.ReadWriteCloser(conn),
-			cfg.Storage,
-			cfg.MessageChan,
-			cfg.Hostname,
-			cfg.Monkey,
-		)
+	if m != nil {
+		ok := m.Accept(conn)
+		if !ok {
+			metrics.SessionsRejected.WithLabelValues("monkey").Inc()
+			conn.Close()
+			return
+		}
 	}
+	metrics.SessionsAccepted.Inc()
+
+	Accept(
+		netutil.RemoteAddr(conn),
+		io.ReadWriteCloser(conn),
+		cfg.Storage,
+		cfg.Bus,
+		cfg.Hostname,
+		m,
+		cfg.Transcripts,
+		cfg.SMTPTLS,
+	)
 }
@@ -0,0 +1,116 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+)
+
+// SelfSigned returns a self-signed certificate for hosts, which may be
+// hostnames or IP addresses, valid between notBefore and notAfter
+func SelfSigned(hosts []string, notBefore, notAfter time.Time) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"MailHog"}},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// ServerConfig returns a TLS config using the certificate and key in
+// certFile and keyFile, or a self-signed certificate for hosts valid for
+// a year if selfSigned is set
+//
+// If clientCA is set, clients must present a certificate signed by a CA
+// in that PEM file.
+func ServerConfig(certFile, keyFile string, selfSigned bool, hosts []string, clientCA string) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case len(certFile) > 0 || len(keyFile) > 0:
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	case selfSigned:
+		now := time.Now()
+		cert, err = SelfSigned(hosts, now.Add(-time.Hour), now.AddDate(1, 0, 0))
+	default:
+		return nil, errors.New("TLS requires a certificate and key, or a self-signed certificate")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(clientCA) > 0 {
+		b, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificates found in " + clientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// RedirectHandler redirects requests to the same URL using HTTPS on the
+// port in tlsAddr
+func RedirectHandler(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if len(port) > 0 && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,49 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSelfSigned(t *testing.T) {
+	Convey("SelfSigned should generate a certificate for the hosts", t, func() {
+		now := time.Now()
+		cert, err := SelfSigned([]string{"mailhog.example", "127.0.0.1"}, now, now.Add(time.Hour))
+		So(err, ShouldBeNil)
+
+		x, err := x509.ParseCertificate(cert.Certificate[0])
+		So(err, ShouldBeNil)
+		So(x.VerifyHostname("mailhog.example"), ShouldBeNil)
+		So(x.VerifyHostname("127.0.0.1"), ShouldBeNil)
+		So(x.VerifyHostname("other.example"), ShouldNotBeNil)
+	})
+
+	Convey("ServerConfig should require a certificate", t, func() {
+		_, err := ServerConfig("", "", false, nil, "")
+		So(err, ShouldNotBeNil)
+
+		cfg, err := ServerConfig("", "", true, []string{"localhost"}, "")
+		So(err, ShouldBeNil)
+		So(cfg.Certificates, ShouldHaveLength, 1)
+		So(cfg.ClientAuth, ShouldEqual, tls.NoClientCert)
+	})
+}
+
+func TestRedirectHandler(t *testing.T) {
+	Convey("RedirectHandler should redirect to HTTPS", t, func() {
+		r := httptest.NewRequest("DELETE", "http://mailhog.example:8080/api/v1/messages?x=1", nil)
+		w := httptest.NewRecorder()
+		RedirectHandler("0.0.0.0:8025").ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, 308)
+		So(w.Header().Get("Location"), ShouldEqual, "https://mailhog.example:8025/api/v1/messages?x=1")
+
+		w = httptest.NewRecorder()
+		RedirectHandler(":443").ServeHTTP(w, r)
+		So(w.Header().Get("Location"), ShouldEqual, "https://mailhog.example/api/v1/messages?x=1")
+	})
+}
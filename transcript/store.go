@@ -0,0 +1,116 @@
+package transcript
+
+import "sync"
+
+// Store keeps the transcripts of recent sessions
+//
+// Transcripts of sessions which delivered messages are kept by message ID,
+// up to a limit after which the oldest are discarded. Sessions which ended
+// without delivering a message are kept in a separate, bounded session log.
+type Store struct {
+	mu           sync.Mutex
+	messages     map[string]*Recorder
+	order        []string
+	messageLimit int
+	sessions     []*Recorder
+	sessionLimit int
+}
+
+// NewStore returns a Store keeping up to messageLimit message transcripts
+// and sessionLimit undelivered session transcripts
+func NewStore(messageLimit, sessionLimit int) *Store {
+	return &Store{
+		messages:     make(map[string]*Recorder),
+		messageLimit: messageLimit,
+		sessionLimit: sessionLimit,
+	}
+}
+
+// Attach associates a session transcript with a stored message
+func (s *Store) Attach(id string, r *Recorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.messageLimit <= 0 {
+		return
+	}
+	if _, ok := s.messages[id]; !ok {
+		s.order = append(s.order, id)
+	}
+	s.messages[id] = r
+
+	for len(s.order) > s.messageLimit {
+		delete(s.messages, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// Finish adds a completed session to the session log if it didn't
+// deliver any messages
+func (s *Store) Finish(r *Recorder) {
+	if len(r.Transcript().Messages) > 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessionLimit <= 0 {
+		return
+	}
+	s.sessions = append(s.sessions, r)
+	if len(s.sessions) > s.sessionLimit {
+		s.sessions = s.sessions[len(s.sessions)-s.sessionLimit:]
+	}
+}
+
+// Message returns the transcript attached to a message
+func (s *Store) Message(id string) (Transcript, bool) {
+	s.mu.Lock()
+	r, ok := s.messages[id]
+	s.mu.Unlock()
+
+	if !ok {
+		return Transcript{}, false
+	}
+	return r.Transcript(), true
+}
+
+// Sessions returns the session log, oldest first
+func (s *Store) Sessions() []Transcript {
+	s.mu.Lock()
+	recorders := append([]*Recorder(nil), s.sessions...)
+	s.mu.Unlock()
+
+	transcripts := make([]Transcript, 0, len(recorders))
+	for _, r := range recorders {
+		transcripts = append(transcripts, r.Transcript())
+	}
+	return transcripts
+}
+
+// Delete removes the transcript attached to a message
+func (s *Store) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.messages[id]; !ok {
+		return
+	}
+	delete(s.messages, id)
+	for i, o := range s.order {
+		if o == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// DeleteAll removes all message transcripts
+func (s *Store) DeleteAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = make(map[string]*Recorder)
+	s.order = nil
+}
@@ -0,0 +1,180 @@
+package transcript
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Received marks a line sent by the client
+	Received = "received"
+	// Sent marks a line sent by the server
+	Sent = "sent"
+)
+
+// Entry is a single line of an SMTP conversation
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	// Read is the read from the connection which returned the line. Lines
+	// sharing a read were pipelined by the client.
+	Read int    `json:"read,omitempty"`
+	Line string `json:"line"`
+	// Delay is the time a reply was held back by a chaos monkey before
+	// its first line was sent
+	Delay time.Duration `json:"delay,omitempty"`
+}
+
+// Transcript is a structured record of an SMTP session
+type Transcript struct {
+	SessionID     string     `json:"sessionId"`
+	RemoteAddress string     `json:"remoteAddress"`
+	Started       time.Time  `json:"started"`
+	Ended         *time.Time `json:"ended,omitempty"`
+	TLS           bool       `json:"tls"`
+	Helo          string     `json:"helo,omitempty"`
+	Extensions    []string   `json:"extensions,omitempty"`
+	AuthMechanism string     `json:"authMechanism,omitempty"`
+	Messages      []string   `json:"messages,omitempty"`
+	Entries       []Entry    `json:"entries"`
+}
+
+// Recorder records the Transcript of a session in progress
+type Recorder struct {
+	mu          sync.Mutex
+	t           Transcript
+	read        int
+	commandRead int
+	delay       time.Duration
+}
+
+// NewRecorder starts recording a session
+func NewRecorder(sessionID, remoteAddress string) *Recorder {
+	return &Recorder{
+		t: Transcript{
+			SessionID:     sessionID,
+			RemoteAddress: remoteAddress,
+			Started:       time.Now(),
+		},
+	}
+}
+
+// Read marks the start of a new read from the connection
+func (r *Recorder) Read() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.read++
+}
+
+// Received records a command line sent by the client
+func (r *Recorder) Received(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.append(Received, line)
+
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return
+	}
+	if r.commandRead == r.read {
+		r.extension("PIPELINING")
+	}
+	r.commandRead = r.read
+
+	switch strings.ToUpper(f[0]) {
+	case "HELO", "EHLO":
+		r.t.Helo = line
+	case "STARTTLS":
+		r.extension("STARTTLS")
+	case "AUTH":
+		r.extension("AUTH")
+		if len(f) > 1 {
+			r.t.AuthMechanism = strings.ToUpper(f[1])
+		}
+	case "MAIL", "RCPT":
+		// ESMTP parameters follow the path, e.g. MAIL FROM:<a@b> SIZE=100
+		if i := strings.Index(line, ">"); i > -1 {
+			for _, p := range strings.Fields(line[i+1:]) {
+				r.extension(strings.ToUpper(strings.SplitN(p, "=", 2)[0]))
+			}
+		}
+	}
+}
+
+// Data records the size of message data received from the client
+func (r *Recorder) Data(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.append(Received, fmt.Sprintf("<%d bytes of message data>", n))
+}
+
+// Sent records a reply line sent by the server
+func (r *Recorder) Sent(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.append(Sent, line)
+	if r.delay > 0 {
+		r.t.Entries[len(r.t.Entries)-1].Delay = r.delay
+		r.delay = 0
+	}
+}
+
+// Delayed records a delay before the next reply line is sent
+func (r *Recorder) Delayed(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delay = d
+}
+
+// SetTLS records the TLS state of the session
+func (r *Recorder) SetTLS(tls bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.t.TLS = tls
+}
+
+// Delivered records a message stored during the session
+func (r *Recorder) Delivered(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.t.Messages = append(r.t.Messages, id)
+}
+
+// End marks the end of the session
+func (r *Recorder) End() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.t.Ended = &now
+}
+
+// Transcript returns a copy of the transcript recorded so far
+func (r *Recorder) Transcript() Transcript {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.t
+	t.Extensions = append([]string(nil), r.t.Extensions...)
+	t.Messages = append([]string(nil), r.t.Messages...)
+	t.Entries = append([]Entry(nil), r.t.Entries...)
+	return t
+}
+
+func (r *Recorder) append(direction, line string) {
+	r.t.Entries = append(r.t.Entries, Entry{
+		Time:      time.Now(),
+		Direction: direction,
+		Read:      r.read,
+		Line:      line,
+	})
+}
+
+func (r *Recorder) extension(ext string) {
+	for _, e := range r.t.Extensions {
+		if e == ext {
+			return
+		}
+	}
+	r.t.Extensions = append(r.t.Extensions, ext)
+}
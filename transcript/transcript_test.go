@@ -0,0 +1,70 @@
+package transcript
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRecorder(t *testing.T) {
+	Convey("Recorder should record session details", t, func() {
+		r := NewRecorder("abc", "1.1.1.1:11111")
+		r.Read()
+		r.Received("EHLO localhost")
+		r.Sent("250-Hello localhost")
+		r.Read()
+		r.Received("STARTTLS")
+		r.SetTLS(true)
+		r.Read()
+		r.Received("AUTH PLAIN <redacted>")
+		r.Read()
+		r.Received("MAIL FROM:<test> SIZE=100 BODY=8BITMIME")
+		r.Received("RCPT TO:<test>")
+		r.Data(4)
+		r.Delivered("1@localhost")
+		r.End()
+
+		tr := r.Transcript()
+		So(tr.SessionID, ShouldEqual, "abc")
+		So(tr.Helo, ShouldEqual, "EHLO localhost")
+		So(tr.AuthMechanism, ShouldEqual, "PLAIN")
+		So(tr.Extensions, ShouldResemble, []string{"STARTTLS", "AUTH", "SIZE", "BODY", "PIPELINING"})
+		So(tr.Messages, ShouldResemble, []string{"1@localhost"})
+		So(tr.TLS, ShouldBeTrue)
+		So(tr.Entries, ShouldHaveLength, 7)
+		So(tr.Entries[5].Read, ShouldEqual, 4)
+		So(tr.Ended, ShouldNotBeNil)
+	})
+}
+
+func TestStore(t *testing.T) {
+	Convey("Store should discard the oldest message transcripts", t, func() {
+		s := NewStore(2, 1)
+		s.Attach("1", NewRecorder("a", ""))
+		s.Attach("2", NewRecorder("b", ""))
+		s.Attach("3", NewRecorder("c", ""))
+
+		_, ok := s.Message("1")
+		So(ok, ShouldBeFalse)
+		tr, ok := s.Message("3")
+		So(ok, ShouldBeTrue)
+		So(tr.SessionID, ShouldEqual, "c")
+
+		s.Delete("3")
+		_, ok = s.Message("3")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Store should only log undelivered sessions", t, func() {
+		s := NewStore(2, 1)
+		delivered := NewRecorder("a", "")
+		delivered.Delivered("1")
+		s.Finish(delivered)
+		So(s.Sessions(), ShouldBeEmpty)
+
+		s.Finish(NewRecorder("b", ""))
+		s.Finish(NewRecorder("c", ""))
+		So(s.Sessions(), ShouldHaveLength, 1)
+		So(s.Sessions()[0].SessionID, ShouldEqual, "c")
+	})
+}
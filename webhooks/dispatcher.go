@@ -0,0 +1,352 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailhog/data"
+)
+
+const (
+	attemptLogSize    = 500
+	deadLetterLogSize = 100
+	// queueSize is the number of deliveries which can wait for a worker,
+	// including retries which are due
+	queueSize = 1000
+)
+
+var errQueueFull = errors.New("delivery queue full")
+
+// Attempt records a single delivery attempt
+type Attempt struct {
+	DeliveryID string        `json:"deliveryId"`
+	WebhookID  string        `json:"webhookId"`
+	MessageID  string        `json:"messageId"`
+	Attempt    int           `json:"attempt"`
+	Time       time.Time     `json:"time"`
+	Duration   time.Duration `json:"duration"`
+	StatusCode int           `json:"statusCode,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// DeadLetter is a delivery which failed every attempt
+type DeadLetter struct {
+	DeliveryID string    `json:"deliveryId"`
+	WebhookID  string    `json:"webhookId"`
+	MessageID  string    `json:"messageId"`
+	Attempts   int       `json:"attempts"`
+	Time       time.Time `json:"time"`
+	Error      string    `json:"error"`
+
+	delivery *delivery
+}
+
+type delivery struct {
+	id        string
+	hook      *Webhook
+	messageID string
+	body      []byte
+	// attempt is the number of attempts made, and backoff the delay
+	// before the last retry
+	attempt int
+	backoff time.Duration
+}
+
+// Dispatcher delivers received messages to webhooks
+type Dispatcher struct {
+	// Backoff is the delay before the first retry, doubling after each
+	// failed attempt up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Workers is the number of deliveries attempted at once. Deliveries
+	// are dead lettered if too many are waiting.
+	Workers int
+
+	start       sync.Once
+	queue       chan *delivery
+	mu          sync.RWMutex
+	hooks       map[string]*Webhook
+	order       []string
+	attempts    []Attempt
+	deadLetters []*DeadLetter
+	client      *http.Client
+}
+
+// NewDispatcher returns a Dispatcher without any webhooks
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		Backoff:    time.Second,
+		MaxBackoff: time.Minute,
+		Workers:    4,
+		queue:      make(chan *delivery, queueSize),
+		hooks:      make(map[string]*Webhook),
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Add validates and adds a webhook, assigning it an ID if it doesn't have one
+func (d *Dispatcher) Add(h *Webhook) error {
+	if err := h.compile(); err != nil {
+		return err
+	}
+	if len(h.ID) == 0 {
+		h.ID = newID()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.hooks[h.ID]; !ok {
+		d.order = append(d.order, h.ID)
+	}
+	d.hooks[h.ID] = h
+	return nil
+}
+
+// Update replaces an existing webhook. The existing secret is kept if h
+// doesn't have one, or has RedactedSecret, so a webhook read from the API
+// can be changed and written back.
+func (d *Dispatcher) Update(id string, h *Webhook) error {
+	cur, ok := d.Get(id)
+	if !ok {
+		return ErrNotFound
+	}
+	if len(h.Secret) == 0 || h.Secret == RedactedSecret {
+		h.Secret = cur.Secret
+	}
+	h.ID = id
+	return d.Add(h)
+}
+
+// Remove deletes a webhook
+func (d *Dispatcher) Remove(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.hooks[id]; !ok {
+		return ErrNotFound
+	}
+	delete(d.hooks, id)
+	for i, o := range d.order {
+		if o == id {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Get returns a webhook by ID
+func (d *Dispatcher) Get(id string) (*Webhook, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	h, ok := d.hooks[id]
+	return h, ok
+}
+
+// List returns all webhooks in the order they were added
+func (d *Dispatcher) List() []*Webhook {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	hooks := make([]*Webhook, 0, len(d.order))
+	for _, id := range d.order {
+		hooks = append(hooks, d.hooks[id])
+	}
+	return hooks
+}
+
+// Notify starts delivering msg to every matching webhook. It doesn't block.
+func (d *Dispatcher) Notify(msg *data.Message) {
+	for _, h := range d.List() {
+		if !h.Matches(msg) {
+			continue
+		}
+		body, err := json.Marshal(newPayload(msg, h.Payload == PayloadFull))
+		if err != nil {
+			slog.Error("Error encoding webhook payload", "webhook", h.ID, "error", err)
+			continue
+		}
+		d.enqueue(&delivery{
+			id:        newID(),
+			hook:      h,
+			messageID: string(msg.ID),
+			body:      body,
+		})
+	}
+}
+
+// Attempts returns recent delivery attempts for a webhook, oldest first
+func (d *Dispatcher) Attempts(webhookID string) []Attempt {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	attempts := make([]Attempt, 0)
+	for _, a := range d.attempts {
+		if a.WebhookID == webhookID {
+			attempts = append(attempts, a)
+		}
+	}
+	return attempts
+}
+
+// DeadLetters returns deliveries which failed every attempt, oldest first
+func (d *Dispatcher) DeadLetters() []DeadLetter {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	letters := make([]DeadLetter, 0, len(d.deadLetters))
+	for _, l := range d.deadLetters {
+		letters = append(letters, *l)
+	}
+	return letters
+}
+
+// Retry removes a dead letter and starts delivering it again
+func (d *Dispatcher) Retry(deliveryID string) error {
+	d.mu.Lock()
+	var letter *DeadLetter
+	for i, l := range d.deadLetters {
+		if l.DeliveryID == deliveryID {
+			letter = l
+			d.deadLetters = append(d.deadLetters[:i], d.deadLetters[i+1:]...)
+			break
+		}
+	}
+	d.mu.Unlock()
+
+	if letter == nil {
+		return ErrNotFound
+	}
+	letter.delivery.attempt, letter.delivery.backoff = 0, 0
+	d.enqueue(letter.delivery)
+	return nil
+}
+
+// ClearDeadLetters discards all dead letters
+func (d *Dispatcher) ClearDeadLetters() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadLetters = nil
+}
+
+// enqueue queues a delivery for the next free worker, or dead letters it
+// if the queue is full
+func (d *Dispatcher) enqueue(del *delivery) {
+	d.start.Do(func() {
+		for i := 0; i < d.Workers; i++ {
+			go d.work()
+		}
+	})
+	select {
+	case d.queue <- del:
+	default:
+		slog.Warn("Webhook delivery queue full", "webhook", del.hook.ID, "message", del.messageID)
+		d.deadLetter(del, errQueueFull)
+	}
+}
+
+func (d *Dispatcher) work() {
+	for del := range d.queue {
+		d.deliver(del)
+	}
+}
+
+// deliver makes the next attempt at a delivery. If it fails, the delivery
+// is queued again after a backoff, or dead lettered after its last attempt.
+func (d *Dispatcher) deliver(del *delivery) {
+	del.attempt++
+	err := d.post(del, del.attempt)
+	if err == nil {
+		return
+	}
+	slog.Warn("Webhook delivery failed", "webhook", del.hook.ID, "message", del.messageID, "attempt", del.attempt, "error", err)
+
+	if del.attempt >= del.hook.MaxAttempts {
+		d.deadLetter(del, err)
+		return
+	}
+	if del.backoff == 0 {
+		del.backoff = d.Backoff
+	} else if del.backoff *= 2; del.backoff > d.MaxBackoff {
+		del.backoff = d.MaxBackoff
+	}
+	time.AfterFunc(del.backoff, func() { d.enqueue(del) })
+}
+
+func (d *Dispatcher) deadLetter(del *delivery, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadLetters = append(d.deadLetters, &DeadLetter{
+		DeliveryID: del.id,
+		WebhookID:  del.hook.ID,
+		MessageID:  del.messageID,
+		Attempts:   del.attempt,
+		Time:       time.Now(),
+		Error:      err.Error(),
+		delivery:   del,
+	})
+	if len(d.deadLetters) > deadLetterLogSize {
+		d.deadLetters = d.deadLetters[len(d.deadLetters)-deadLetterLogSize:]
+	}
+}
+
+func (d *Dispatcher) post(del *delivery, attempt int) (err error) {
+	a := Attempt{
+		DeliveryID: del.id,
+		WebhookID:  del.hook.ID,
+		MessageID:  del.messageID,
+		Attempt:    attempt,
+		Time:       time.Now(),
+	}
+	defer func() {
+		a.Duration = time.Since(a.Time)
+		if err != nil {
+			a.Error = err.Error()
+		}
+		d.record(a)
+	}()
+
+	req, err := http.NewRequest("POST", del.hook.URL, bytes.NewReader(del.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-MailHog-Event", "message.received")
+	req.Header.Set("X-MailHog-Delivery", del.id)
+	if len(del.hook.Secret) > 0 {
+		req.Header.Set("X-MailHog-Signature", "sha256="+Sign(del.hook.Secret, del.body))
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	a.StatusCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (d *Dispatcher) record(a Attempt) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.attempts = append(d.attempts, a)
+	if len(d.attempts) > attemptLogSize {
+		d.attempts = d.attempts[len(d.attempts)-attemptLogSize:]
+	}
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body using secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,140 @@
+package webhooks
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mailhog/data"
+)
+
+func testMessage() *data.Message {
+	return &data.Message{
+		ID:   "1@mailhog.example",
+		From: &data.Path{Mailbox: "from", Domain: "mailhog.example"},
+		To:   []*data.Path{{Mailbox: "to", Domain: "mailhog.example"}},
+		Content: &data.Content{
+			Headers: map[string][]string{"Subject": {"Hello"}},
+		},
+	}
+}
+
+func waitFor(f func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if f() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestDispatcher(t *testing.T) {
+	Convey("Dispatcher should post signed payloads to matching webhooks", t, func() {
+		bodies := make(chan []byte, 1)
+		signatures := make(chan string, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			bodies <- b
+			signatures <- r.Header.Get("X-MailHog-Signature")
+		}))
+		defer srv.Close()
+
+		d := NewDispatcher()
+		So(d.Add(&Webhook{URL: srv.URL, Secret: "s3cret", Recipient: "^to@"}), ShouldBeNil)
+		So(d.Add(&Webhook{URL: srv.URL, Subject: "^Goodbye$"}), ShouldBeNil)
+
+		d.Notify(testMessage())
+
+		b := <-bodies
+		So(<-signatures, ShouldEqual, "sha256="+Sign("s3cret", b))
+		So(waitFor(func() bool { return len(d.Attempts(d.List()[0].ID)) == 1 }), ShouldBeTrue)
+		So(d.Attempts(d.List()[1].ID), ShouldBeEmpty)
+	})
+
+	Convey("Dispatcher should retry failed deliveries then dead letter them", t, func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(500)
+		}))
+		defer srv.Close()
+
+		d := NewDispatcher()
+		d.Backoff = time.Millisecond
+		h := &Webhook{URL: srv.URL, MaxAttempts: 3}
+		So(d.Add(h), ShouldBeNil)
+
+		d.Notify(testMessage())
+
+		So(waitFor(func() bool { return len(d.DeadLetters()) == 1 }), ShouldBeTrue)
+		So(d.Attempts(h.ID), ShouldHaveLength, 3)
+		So(d.DeadLetters()[0].Attempts, ShouldEqual, 3)
+
+		So(d.Retry(d.DeadLetters()[0].DeliveryID), ShouldBeNil)
+		So(d.DeadLetters(), ShouldBeEmpty)
+	})
+
+	Convey("Dispatcher should limit the deliveries attempted at once", t, func() {
+		var active, most int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			w.WriteHeader(500)
+		}))
+		defer srv.Close()
+
+		d := NewDispatcher()
+		d.Backoff = time.Millisecond
+		d.Workers = 2
+		h := &Webhook{URL: srv.URL, MaxAttempts: 2}
+		So(d.Add(h), ShouldBeNil)
+
+		for i := 0; i < 10; i++ {
+			d.Notify(testMessage())
+		}
+
+		So(waitFor(func() bool { return len(d.DeadLetters()) == 10 }), ShouldBeTrue)
+		So(d.Attempts(h.ID), ShouldHaveLength, 20)
+		So(atomic.LoadInt32(&most), ShouldBeBetweenOrEqual, 1, 2)
+	})
+
+	Convey("Update should keep the secret of a redacted webhook", t, func() {
+		d := NewDispatcher()
+		h := &Webhook{URL: "http://example", Secret: "s3cret"}
+		So(d.Add(h), ShouldBeNil)
+
+		r := h.Redacted()
+		So(r.Secret, ShouldEqual, RedactedSecret)
+		r.Subject = "^Hello$"
+		So(d.Update(h.ID, r), ShouldBeNil)
+		u, _ := d.Get(h.ID)
+		So(u.Secret, ShouldEqual, "s3cret")
+		So(u.Subject, ShouldEqual, "^Hello$")
+
+		So(d.Update(h.ID, &Webhook{URL: "http://example"}), ShouldBeNil)
+		u, _ = d.Get(h.ID)
+		So(u.Secret, ShouldEqual, "s3cret")
+
+		So(d.Update(h.ID, &Webhook{URL: "http://example", Secret: "n3w"}), ShouldBeNil)
+		u, _ = d.Get(h.ID)
+		So(u.Secret, ShouldEqual, "n3w")
+	})
+
+	Convey("Add should reject invalid webhooks", t, func() {
+		d := NewDispatcher()
+		So(d.Add(&Webhook{URL: "ftp://example"}), ShouldNotBeNil)
+		So(d.Add(&Webhook{URL: "http://example", Payload: "everything"}), ShouldNotBeNil)
+		So(d.Add(&Webhook{URL: "http://example", Subject: "("}), ShouldNotBeNil)
+	})
+}
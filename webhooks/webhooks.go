@@ -0,0 +1,182 @@
+package webhooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/mailhog/data"
+)
+
+const (
+	// PayloadSummary posts a summary of the message
+	PayloadSummary = "summary"
+	// PayloadFull posts the summary and the full message
+	PayloadFull = "full"
+)
+
+// RedactedSecret replaces webhook secrets returned by the API
+const RedactedSecret = "********"
+
+// DefaultMaxAttempts is the number of delivery attempts made if a
+// webhook doesn't set MaxAttempts
+const DefaultMaxAttempts = 5
+
+// Webhook is an outgoing HTTP notification for received messages
+type Webhook struct {
+	ID      string `json:"id"`
+	URL     string `json:"url"`
+	Payload string `json:"payload"`
+	// Recipient and Subject are optional regular expressions. A message
+	// must match both to be delivered.
+	Recipient   string `json:"recipient,omitempty"`
+	Subject     string `json:"subject,omitempty"`
+	Secret      string `json:"secret,omitempty"`
+	MaxAttempts int    `json:"maxAttempts"`
+
+	recipient *regexp.Regexp
+	subject   *regexp.Regexp
+}
+
+// compile validates the webhook and compiles its filters
+func (h *Webhook) compile() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid webhook url: %s", h.URL)
+	}
+
+	switch h.Payload {
+	case "":
+		h.Payload = PayloadSummary
+	case PayloadSummary, PayloadFull:
+	default:
+		return fmt.Errorf("invalid webhook payload: %s", h.Payload)
+	}
+
+	if h.MaxAttempts <= 0 {
+		h.MaxAttempts = DefaultMaxAttempts
+	}
+
+	if h.recipient, err = compilePattern(h.Recipient); err != nil {
+		return fmt.Errorf("invalid recipient pattern: %s", err)
+	}
+	if h.subject, err = compilePattern(h.Subject); err != nil {
+		return fmt.Errorf("invalid subject pattern: %s", err)
+	}
+	return nil
+}
+
+func compilePattern(p string) (*regexp.Regexp, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	return regexp.Compile(p)
+}
+
+// Matches returns true if msg passes the webhook filters
+func (h *Webhook) Matches(msg *data.Message) bool {
+	if h.recipient != nil {
+		matched := false
+		for _, to := range msg.To {
+			if h.recipient.MatchString(to.Mailbox + "@" + to.Domain) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if h.subject != nil && !h.subject.MatchString(subject(msg)) {
+		return false
+	}
+	return true
+}
+
+// Redacted returns a copy of the webhook without its secret
+func (h *Webhook) Redacted() *Webhook {
+	r := *h
+	if len(r.Secret) > 0 {
+		r.Secret = RedactedSecret
+	}
+	return &r
+}
+
+// Summary describes a received message
+type Summary struct {
+	ID      string    `json:"id"`
+	From    string    `json:"from"`
+	To      []string  `json:"to"`
+	Subject string    `json:"subject"`
+	Created time.Time `json:"created"`
+	Size    int       `json:"size"`
+}
+
+// Payload is the body posted to a webhook
+type Payload struct {
+	Event   string        `json:"event"`
+	Summary Summary       `json:"summary"`
+	Message *data.Message `json:"message,omitempty"`
+}
+
+func newPayload(msg *data.Message, full bool) *Payload {
+	p := &Payload{
+		Event: "message.received",
+		Summary: Summary{
+			ID:      string(msg.ID),
+			Subject: subject(msg),
+			Created: msg.Created,
+		},
+	}
+	if msg.From != nil {
+		p.Summary.From = msg.From.Mailbox + "@" + msg.From.Domain
+	}
+	for _, to := range msg.To {
+		p.Summary.To = append(p.Summary.To, to.Mailbox+"@"+to.Domain)
+	}
+	if msg.Content != nil {
+		p.Summary.Size = msg.Content.Size
+	}
+	if full {
+		p.Message = msg
+	}
+	return p
+}
+
+func subject(msg *data.Message) string {
+	if msg.Content == nil {
+		return ""
+	}
+	if s, ok := msg.Content.Headers["Subject"]; ok && len(s) > 0 {
+		return s[0]
+	}
+	return ""
+}
+
+// Load reads a JSON array of webhooks from file
+func Load(file string) ([]*Webhook, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []*Webhook
+	if err := json.Unmarshal(b, &hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// ErrNotFound is returned for unknown webhooks or dead letters
+var ErrNotFound = errors.New("not found")
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,6 +1,7 @@
 package websockets
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -13,14 +14,17 @@ const (
 	pongWait = 60 * time.Second
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
-	// Maximum message size allowed from peer. Set to minimum allowed value as we don't expect the client to send non-control messages.
-	maxMessageSize = 1
+	// Maximum message size allowed from peer. Clients only send subscription requests.
+	maxMessageSize = 4096
 )
 
 type connection struct {
 	hub  *Hub
 	ws   *websocket.Conn
 	send chan interface{}
+
+	// subscription is owned by the hub goroutine
+	subscription *Subscription
 }
 
 func (c *connection) readLoop() {
@@ -32,10 +36,40 @@ func (c *connection) readLoop() {
 	c.ws.SetReadDeadline(time.Now().Add(pongWait))
 	c.ws.SetPongHandler(func(string) error { c.ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		if _, _, err := c.ws.NextReader(); err != nil {
+		_, r, err := c.ws.NextReader()
+		if err != nil {
 			return
 		}
+		var s Subscription
+		if err := json.NewDecoder(r).Decode(&s); err != nil {
+			continue
+		}
+		switch s.Type {
+		case "subscribe":
+			c.hub.subscribeChan <- &subscribeRequest{c, &s}
+		case "unsubscribe":
+			c.hub.subscribeChan <- &subscribeRequest{c, nil}
+		}
+	}
+}
+
+// payload returns what should be sent to the client for m, or nil if
+// the client isn't interested
+func (c *connection) payload(m interface{}) interface{} {
+	e, ok := m.(*Event)
+	if !ok {
+		return m
+	}
+	if c.subscription == nil {
+		if e.Type == MessageCreated {
+			return e.Data
+		}
+		return nil
+	}
+	if c.subscription.Wants(e) {
+		return e
 	}
+	return nil
 }
 
 func (c *connection) writeLoop() {
@@ -0,0 +1,147 @@
+package websockets
+
+import (
+	"strings"
+
+	"github.com/mailhog/data"
+)
+
+// Event types sent to subscribed clients
+const (
+	MessageCreated  = "message.created"
+	MessageDeleted  = "message.deleted"
+	MessagesCleared = "messages.cleared"
+	MessageReleased = "message.released"
+	JimChanged      = "jim.changed"
+	RulesChanged    = "rules.changed"
+	ScenarioChanged = "jim.scenario"
+
+	// JimDecision is sent with Notify, so it isn't replayed to clients
+	// which reconnect
+	JimDecision = "jim.decision"
+
+	// HistoryTruncated is sent before replayed events if some of the
+	// events requested are no longer in the hub's history
+	HistoryTruncated = "history.truncated"
+)
+
+// Event is a typed notification sent to websocket clients
+type Event struct {
+	// Seq is assigned by the hub when the event is published, and can be
+	// used to resume from this event after reconnecting
+	Seq  uint64      `json:"seq,omitempty"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data,omitempty"`
+
+	// Message is the message the event relates to, if any. It is used to
+	// apply subscription filters and isn't sent to clients.
+	Message *data.Message `json:"-"`
+}
+
+// Filter restricts the message events sent to a subscriber. Empty
+// fields match every message.
+type Filter struct {
+	// Recipient matches messages sent to this address
+	Recipient string `json:"recipient,omitempty"`
+	// Namespace matches messages sent to any address in this domain or
+	// its subdomains
+	Namespace string `json:"namespace,omitempty"`
+	// Kind and Query match messages in the same way as /api/v2/search
+	Kind  string `json:"kind,omitempty"`
+	Query string `json:"query,omitempty"`
+}
+
+// Subscription is sent by a client to choose the events it receives
+//
+// A client which hasn't subscribed receives each new message, without an
+// event envelope, for compatibility with older clients.
+type Subscription struct {
+	Type   string   `json:"type"`
+	Events []string `json:"events,omitempty"`
+	Filter Filter   `json:"filter"`
+	// Since, if set, replays the matching events published after this
+	// sequence number
+	Since *uint64 `json:"since,omitempty"`
+}
+
+// Wants returns true if the subscriber should be sent e
+func (s *Subscription) Wants(e *Event) bool {
+	if len(s.Events) > 0 {
+		found := false
+		for _, t := range s.Events {
+			if t == e.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if e.Message == nil {
+		return true
+	}
+	return s.Filter.Matches(e.Message)
+}
+
+// Matches returns true if msg passes the filter
+func (f *Filter) Matches(msg *data.Message) bool {
+	if len(f.Recipient) > 0 || len(f.Namespace) > 0 {
+		matched := false
+		for _, to := range msg.To {
+			if f.matchesRecipient(to) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(f.Query) == 0 {
+		return true
+	}
+	query := strings.ToLower(f.Query)
+	switch f.Kind {
+	case "from":
+		return msg.From != nil && strings.Contains(strings.ToLower(msg.From.Mailbox+"@"+msg.From.Domain), query)
+	case "to":
+		for _, to := range msg.To {
+			if strings.Contains(strings.ToLower(to.Mailbox+"@"+to.Domain), query) {
+				return true
+			}
+		}
+		return false
+	case "containing":
+		if msg.Content == nil {
+			return false
+		}
+		if strings.Contains(strings.ToLower(msg.Content.Body), query) {
+			return true
+		}
+		for _, h := range msg.Content.Headers {
+			for _, v := range h {
+				if strings.Contains(strings.ToLower(v), query) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (f *Filter) matchesRecipient(to *data.Path) bool {
+	if len(f.Recipient) > 0 && !strings.EqualFold(to.Mailbox+"@"+to.Domain, f.Recipient) {
+		return false
+	}
+	if len(f.Namespace) > 0 {
+		domain := strings.ToLower(to.Domain)
+		ns := strings.ToLower(f.Namespace)
+		if domain != ns && !strings.HasSuffix(domain, "."+ns) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,184 @@
+package websockets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mailhog/data"
+)
+
+func testMessage(to, subject string) *data.Message {
+	p := strings.SplitN(to, "@", 2)
+	return &data.Message{
+		ID:   "1@mailhog.example",
+		From: &data.Path{Mailbox: "from", Domain: "mailhog.example"},
+		To:   []*data.Path{{Mailbox: p[0], Domain: p[1]}},
+		Content: &data.Content{
+			Headers: map[string][]string{"Subject": {subject}},
+			Body:    "Hi.",
+		},
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	Convey("Subscriptions should filter events", t, func() {
+		msg := testMessage("test@run-1.example", "Welcome")
+		created := &Event{Type: MessageCreated, Data: msg, Message: msg}
+
+		s := &Subscription{}
+		So(s.Wants(created), ShouldBeTrue)
+		So(s.Wants(&Event{Type: MessagesCleared}), ShouldBeTrue)
+
+		s = &Subscription{Events: []string{MessageDeleted}}
+		So(s.Wants(created), ShouldBeFalse)
+
+		s = &Subscription{Filter: Filter{Recipient: "TEST@run-1.example"}}
+		So(s.Wants(created), ShouldBeTrue)
+		s = &Subscription{Filter: Filter{Recipient: "other@run-1.example"}}
+		So(s.Wants(created), ShouldBeFalse)
+
+		s = &Subscription{Filter: Filter{Namespace: "example"}}
+		So(s.Wants(created), ShouldBeTrue)
+		s = &Subscription{Filter: Filter{Namespace: "run-2.example"}}
+		So(s.Wants(created), ShouldBeFalse)
+
+		s = &Subscription{Filter: Filter{Kind: "containing", Query: "welcome"}}
+		So(s.Wants(created), ShouldBeTrue)
+		s = &Subscription{Filter: Filter{Kind: "from", Query: "nobody"}}
+		So(s.Wants(created), ShouldBeFalse)
+	})
+}
+
+func TestHubPublish(t *testing.T) {
+	Convey("Hub should send events according to subscriptions", t, func() {
+		hub := NewHub(10)
+		srv := httptest.NewServer(http.HandlerFunc(hub.Serve))
+		defer srv.Close()
+
+		url := "ws" + strings.TrimPrefix(srv.URL, "http")
+		legacy, _, err := websocket.DefaultDialer.Dial(url, nil)
+		So(err, ShouldBeNil)
+		defer legacy.Close()
+		subscribed, _, err := websocket.DefaultDialer.Dial(url, nil)
+		So(err, ShouldBeNil)
+		defer subscribed.Close()
+
+		So(subscribed.WriteJSON(map[string]interface{}{
+			"type":   "subscribe",
+			"events": []string{MessageCreated, MessageDeleted},
+			"filter": map[string]string{"recipient": "test@mailhog.example"},
+		}), ShouldBeNil)
+		var e map[string]interface{}
+		So(subscribed.ReadJSON(&e), ShouldBeNil)
+		So(e["type"], ShouldEqual, "subscribed")
+
+		other := testMessage("other@mailhog.example", "Other")
+		msg := testMessage("test@mailhog.example", "Test")
+		hub.Publish(&Event{Type: MessageCreated, Data: other, Message: other})
+		hub.Publish(&Event{Type: MessagesCleared})
+		hub.Publish(&Event{Type: MessageDeleted, Data: map[string]string{"id": "1"}, Message: msg})
+
+		So(subscribed.ReadJSON(&e), ShouldBeNil)
+		So(e["type"], ShouldEqual, MessageDeleted)
+
+		var m data.Message
+		So(legacy.ReadJSON(&m), ShouldBeNil)
+		So(m.To[0].Mailbox, ShouldEqual, "other")
+	})
+}
+
+func TestHubReplay(t *testing.T) {
+	Convey("Hub should replay events published since a sequence number", t, func() {
+		hub := NewHub(2)
+		srv := httptest.NewServer(http.HandlerFunc(hub.Serve))
+		defer srv.Close()
+
+		for i := 0; i < 3; i++ {
+			hub.Publish(&Event{Type: MessagesCleared})
+		}
+
+		url := "ws" + strings.TrimPrefix(srv.URL, "http")
+		ws, _, err := websocket.DefaultDialer.Dial(url+"?since=2", nil)
+		So(err, ShouldBeNil)
+		defer ws.Close()
+
+		var e Event
+		So(ws.ReadJSON(&e), ShouldBeNil)
+		So(e.Seq, ShouldEqual, 3)
+		hub.Publish(&Event{Type: MessageDeleted})
+		So(ws.ReadJSON(&e), ShouldBeNil)
+		So(e.Seq, ShouldEqual, 4)
+		So(e.Type, ShouldEqual, MessageDeleted)
+
+		l := hub.ListenSince(1)
+		defer hub.Unlisten(l)
+		So((<-l.C).Type, ShouldEqual, HistoryTruncated)
+		So((<-l.C).Seq, ShouldEqual, 3)
+		So((<-l.C).Seq, ShouldEqual, 4)
+
+		_, _, err = websocket.DefaultDialer.Dial(url+"?since=x", nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Hub shouldn't record notifications for replay", t, func() {
+		hub := NewHub(2)
+		srv := httptest.NewServer(http.HandlerFunc(hub.Serve))
+		defer srv.Close()
+
+		url := "ws" + strings.TrimPrefix(srv.URL, "http")
+		ws, _, err := websocket.DefaultDialer.Dial(url+"?since=0", nil)
+		So(err, ShouldBeNil)
+		defer ws.Close()
+
+		hub.Publish(&Event{Type: MessagesCleared})
+		hub.Notify(&Event{Type: JimDecision})
+		hub.Notify(&Event{Type: JimDecision})
+		hub.Publish(&Event{Type: MessageDeleted})
+
+		var e Event
+		for _, t := range []string{MessagesCleared, JimDecision, JimDecision, MessageDeleted} {
+			So(ws.ReadJSON(&e), ShouldBeNil)
+			So(e.Type, ShouldEqual, t)
+		}
+
+		l := hub.ListenSince(0)
+		defer hub.Unlisten(l)
+		So((<-l.C).Type, ShouldEqual, MessagesCleared)
+		e2 := <-l.C
+		So(e2.Type, ShouldEqual, MessageDeleted)
+		So(e2.Seq, ShouldEqual, 2)
+	})
+}
+
+func TestHubOrigins(t *testing.T) {
+	Convey("Hub should only accept allowed origins and authorised clients", t, func() {
+		hub := NewHub(0)
+		srv := httptest.NewServer(http.HandlerFunc(hub.Serve))
+		defer srv.Close()
+		url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+		ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {srv.URL}})
+		So(err, ShouldBeNil)
+		ws.Close()
+
+		origin := http.Header{"Origin": {"http://evil.example"}}
+		_, res, err := websocket.DefaultDialer.Dial(url, origin)
+		So(err, ShouldNotBeNil)
+		So(res.StatusCode, ShouldEqual, 403)
+
+		hub.Origins = []string{"http://evil.example"}
+		ws, _, err = websocket.DefaultDialer.Dial(url, origin)
+		So(err, ShouldBeNil)
+		ws.Close()
+
+		hub.Authorised = func(r *http.Request) bool { return false }
+		_, res, err = websocket.DefaultDialer.Dial(url, nil)
+		So(err, ShouldNotBeNil)
+		So(res.StatusCode, ShouldEqual, 401)
+	})
+}
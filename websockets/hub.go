@@ -1,34 +1,98 @@
 package websockets
 
 import (
+	"log/slog"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/websocket"
-	"github.com/ian-kent/go-log/log"
+	"github.com/mailhog/MailHog-Server/cors"
+	"github.com/mailhog/MailHog-Server/metrics"
 )
 
+// Subprotocol is the websocket subprotocol selected if the client
+// offers it. Clients passing an API token as a subprotocol should also
+// offer this, as browsers reject connections if none of the protocols
+// they offered is selected.
+const Subprotocol = "mailhog"
+
+// sendBuffer is the number of live events buffered for each client, in
+// addition to room for a full replay of the hub's history
+const sendBuffer = 256
+
 type Hub struct {
+	// Origins lists the origins allowed to connect, in addition to the
+	// origin the hub is served from
+	Origins cors.Origins
+	// Authorised, if set, is called before a connection is upgraded.
+	// Connections it returns false for are rejected.
+	Authorised func(*http.Request) bool
+
 	upgrader       websocket.Upgrader
 	connections    map[*connection]bool
+	listeners      map[*Listener]bool
 	messages       chan interface{}
-	registerChan   chan *connection
+	registerChan   chan *registerRequest
 	unregisterChan chan *connection
+	subscribeChan  chan *subscribeRequest
+	listenChan     chan *listenRequest
+	unlistenChan   chan *Listener
+
+	// seq and history are owned by the hub goroutine
+	seq         uint64
+	history     []*Event
+	historySize int
+}
+
+type registerRequest struct {
+	c     *connection
+	since *uint64
+}
+
+type subscribeRequest struct {
+	c            *connection
+	subscription *Subscription
+}
+
+// notification is an event sent by Notify, which isn't recorded
+type notification struct {
+	e *Event
 }
 
-func NewHub() *Hub {
+type listenRequest struct {
+	l     *Listener
+	since *uint64
+}
+
+// Listener receives every event published to a Hub. It is used by
+// consumers other than websocket clients, e.g. the v1 event stream.
+type Listener struct {
+	// C receives events in order. It is closed if the listener falls
+	// behind or is removed with Unlisten.
+	C <-chan *Event
+
+	c chan *Event
+}
+
+// NewHub returns a Hub which keeps the last historySize events for replay
+func NewHub(historySize int) *Hub {
 	hub := &Hub{
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  256,
 			WriteBufferSize: 4096,
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
+			Subprotocols:    []string{Subprotocol},
 		},
 		connections:    make(map[*connection]bool),
+		listeners:      make(map[*Listener]bool),
 		messages:       make(chan interface{}),
-		registerChan:   make(chan *connection),
+		registerChan:   make(chan *registerRequest),
 		unregisterChan: make(chan *connection),
+		subscribeChan:  make(chan *subscribeRequest),
+		listenChan:     make(chan *listenRequest),
+		unlistenChan:   make(chan *Listener),
+		historySize:    historySize,
 	}
+	hub.upgrader.CheckOrigin = hub.checkOrigin
 	go hub.run()
 	return hub
 }
@@ -36,19 +100,104 @@ func NewHub() *Hub {
 func (h *Hub) run() {
 	for {
 		select {
-		case c := <-h.registerChan:
-			h.connections[c] = true
+		case r := <-h.registerChan:
+			h.connections[r.c] = true
+			metrics.WebSocketClients.Inc()
+			if r.since != nil {
+				h.replay(r.c, *r.since)
+			}
 		case c := <-h.unregisterChan:
 			h.unregister(c)
+		case s := <-h.subscribeChan:
+			h.subscribe(s.c, s.subscription)
+		case r := <-h.listenChan:
+			h.listeners[r.l] = true
+			if r.since != nil {
+				for _, e := range h.since(*r.since) {
+					r.l.c <- e
+				}
+			}
+		case l := <-h.unlistenChan:
+			h.unlisten(l)
 		case m := <-h.messages:
-			for c := range h.connections {
-				select {
-				case c.send <- m:
-				default:
-					h.unregister(c)
+			if n, ok := m.(notification); ok {
+				for c := range h.connections {
+					h.send(c, c.payload(n.e))
 				}
+				continue
 			}
+			if e, ok := m.(*Event); ok {
+				h.record(e)
+				for l := range h.listeners {
+					select {
+					case l.c <- e:
+					default:
+						h.unlisten(l)
+					}
+				}
+			}
+			for c := range h.connections {
+				h.send(c, c.payload(m))
+			}
+		}
+	}
+}
+
+func (h *Hub) checkOrigin(r *http.Request) bool {
+	return cors.SameOrigin(r) || h.Origins.Allowed(r.Header.Get("Origin"))
+}
+
+// record assigns e the next sequence number and adds it to the history
+func (h *Hub) record(e *Event) {
+	h.seq++
+	e.Seq = h.seq
+	if h.historySize <= 0 {
+		return
+	}
+	if len(h.history) >= h.historySize {
+		h.history = append(h.history[:0], h.history[len(h.history)-h.historySize+1:]...)
+	}
+	h.history = append(h.history, e)
+}
+
+// since returns the events in the history published after seq
+//
+// If any of those events are no longer in the history, or seq is from
+// before the hub was restarted, the whole history is returned following
+// a HistoryTruncated event.
+func (h *Hub) since(seq uint64) []*Event {
+	var oldest uint64 = h.seq + 1
+	if len(h.history) > 0 {
+		oldest = h.history[0].Seq
+	}
+	if seq > h.seq || seq+1 < oldest {
+		events := []*Event{{Type: HistoryTruncated, Data: map[string]uint64{"oldest": oldest}}}
+		return append(events, h.history...)
+	}
+	return h.history[len(h.history)-int(h.seq-seq):]
+}
+
+func (h *Hub) replay(c *connection, seq uint64) {
+	for _, e := range h.since(seq) {
+		if e.Type == HistoryTruncated {
+			h.send(c, e)
+			continue
 		}
+		h.send(c, c.payload(e))
+	}
+}
+
+func (h *Hub) send(c *connection, payload interface{}) {
+	if payload == nil {
+		return
+	}
+	if _, ok := h.connections[c]; !ok {
+		return
+	}
+	select {
+	case c.send <- payload:
+	default:
+		h.unregister(c)
 	}
 }
 
@@ -56,21 +205,111 @@ func (h *Hub) unregister(c *connection) {
 	if _, ok := h.connections[c]; ok {
 		close(c.send)
 		delete(h.connections, c)
+		metrics.WebSocketClients.Dec()
+	}
+}
+
+func (h *Hub) unlisten(l *Listener) {
+	if _, ok := h.listeners[l]; ok {
+		close(l.c)
+		delete(h.listeners, l)
 	}
 }
 
+func (h *Hub) subscribe(c *connection, s *Subscription) {
+	if _, ok := h.connections[c]; !ok {
+		return
+	}
+
+	reply := &Event{Type: "subscribed", Data: s}
+	if s == nil {
+		reply = &Event{Type: "unsubscribed"}
+	} else if len(s.Filter.Query) > 0 && s.Filter.Kind != "from" && s.Filter.Kind != "to" && s.Filter.Kind != "containing" {
+		reply = &Event{Type: "error", Data: "invalid filter kind: " + s.Filter.Kind}
+		s = c.subscription
+	}
+	c.subscription = s
+
+	h.send(c, reply)
+	if reply.Type == "subscribed" && s.Since != nil {
+		h.replay(c, *s.Since)
+	}
+}
+
+// Serve upgrades the request to a websocket connection and adds it to
+// the hub
+//
+// If the since query parameter is set to a sequence number, the client is
+// subscribed to all events and is sent those published after it before
+// any new events.
 func (h *Hub) Serve(w http.ResponseWriter, r *http.Request) {
+	if h.Authorised != nil && !h.Authorised(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var since *uint64
+	if s := r.URL.Query().Get("since"); len(s) > 0 {
+		seq, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid since: "+s, http.StatusBadRequest)
+			return
+		}
+		since = &seq
+	}
+
 	ws, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Error upgrading websocket connection", "error", err)
 		return
 	}
-	c := &connection{hub: h, ws: ws, send: make(chan interface{}, 256)}
-	h.registerChan <- c
+	c := &connection{hub: h, ws: ws, send: make(chan interface{}, h.historySize+sendBuffer)}
+	if since != nil {
+		c.subscription = &Subscription{Type: "subscribe"}
+	}
+	h.registerChan <- &registerRequest{c, since}
 	go c.writeLoop()
 	go c.readLoop()
 }
 
+// Listen adds a listener which receives new events
+func (h *Hub) Listen() *Listener {
+	return h.listen(nil)
+}
+
+// ListenSince adds a listener which is sent the events published after
+// seq before any new events
+func (h *Hub) ListenSince(seq uint64) *Listener {
+	return h.listen(&seq)
+}
+
+func (h *Hub) listen(since *uint64) *Listener {
+	c := make(chan *Event, h.historySize+sendBuffer)
+	l := &Listener{C: c, c: c}
+	h.listenChan <- &listenRequest{l, since}
+	return l
+}
+
+// Unlisten removes a listener and closes its channel
+func (h *Hub) Unlisten(l *Listener) {
+	h.unlistenChan <- l
+}
+
+// Broadcast sends data to every client, regardless of subscriptions
 func (h *Hub) Broadcast(data interface{}) {
 	h.messages <- data
 }
+
+// Publish sends an event to subscribed clients. Clients without a
+// subscription are sent the message of MessageCreated events only.
+func (h *Hub) Publish(e *Event) {
+	h.messages <- e
+}
+
+// Notify sends an event to subscribed clients without recording it in
+// the history, so it isn't replayed or sent to listeners. It is used for
+// frequent events which would otherwise push older events out of the
+// history.
+func (h *Hub) Notify(e *Event) {
+	h.messages <- notification{e}
+}